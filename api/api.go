@@ -20,6 +20,7 @@
 package api
 
 import (
+	"database/sql"
 	"net"
 	libhttp "net/http"
 	"net/url"
@@ -27,8 +28,12 @@ import (
 	"time"
 
 	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/cache"
 	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/notify"
 	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
 	metrics "github.com/rcrowley/go-metrics"
 	tiger "github.com/rcrowley/go-tigertonic"
 )
@@ -43,20 +48,28 @@ type Stat struct {
 	Name string
 }
 
+type NotifyResult struct {
+	Zone    string
+	Serial  int
+	Targets []string
+}
+
 type HttpServer struct {
 	conn        net.Listener
 	httpPort    string
 	shutdown    chan bool
 	config      *config.Configuration
+	backend     db.Backend
 	readTimeout time.Duration
 	mux         *tiger.TrieServeMux
 }
 
-func NewServer(config *config.Configuration) *HttpServer {
+func NewServer(config *config.Configuration, backend db.Backend) *HttpServer {
 	self := &HttpServer{}
 	self.httpPort = config.ApiServerListen()
 	self.shutdown = make(chan bool, 2)
 	self.config = config
+	self.backend = backend
 	self.mux = tiger.NewTrieServeMux()
 	return self
 }
@@ -83,6 +96,10 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	self.conn = listener
 
 	self.mux.Handle("GET", "/stats", tiger.Marshaled(self.getStats))
+	self.mux.Handle("POST", "/zones/{name}/notify", tiger.Marshaled(self.notifyZone))
+	self.mux.Handle("GET", "/zones/{name}/status", tiger.Marshaled(self.getZoneStatus))
+	self.mux.Handle("DELETE", "/zones/{name}/cache", tiger.Marshaled(self.purgeZoneCache))
+	self.mux.Handle("DELETE", "/cache", tiger.Marshaled(self.purgeCache))
 
 	self.serveListener(listener, self.mux)
 }
@@ -107,6 +124,46 @@ func (self *HttpServer) Close() {
 	}
 }
 
+// Get a zone by the name in the URL.
+func (self *HttpServer) getZone(u *url.URL) (zone db.Zone, err error) {
+	name := dns.Fqdn(strings.ToLower(u.Query().Get("name")))
+	return self.backend.GetZoneByName(name)
+}
+
+func (self *HttpServer) notifyZone(u *url.URL, h libhttp.Header, req *Request) (int, libhttp.Header, *NotifyResult, error) {
+	zone, err := self.getZone(u)
+	if err == sql.ErrNoRows {
+		return libhttp.StatusNotFound, nil, nil, nil
+	} else if err != nil {
+		return 0, nil, nil, err
+	}
+
+	targets := notify.NotifyZone(zone)
+	return libhttp.StatusAccepted, nil, &NotifyResult{Zone: zone.Name, Serial: zone.Serial, Targets: targets}, nil
+}
+
+func (self *HttpServer) getZoneStatus(u *url.URL, h libhttp.Header, req *Request) (int, libhttp.Header, *notify.ZoneStatus, error) {
+	zone, err := self.getZone(u)
+	if err == sql.ErrNoRows {
+		return libhttp.StatusNotFound, nil, nil, nil
+	} else if err != nil {
+		return 0, nil, nil, err
+	}
+
+	status := notify.GetZoneStatus(zone)
+	return libhttp.StatusOK, nil, &status, nil
+}
+
+func (self *HttpServer) purgeZoneCache(u *url.URL, h libhttp.Header, req *Request) (int, libhttp.Header, interface{}, error) {
+	cache.PurgeZone(dns.Fqdn(u.Query().Get("name")))
+	return libhttp.StatusNoContent, nil, nil, nil
+}
+
+func (self *HttpServer) purgeCache(u *url.URL, h libhttp.Header, req *Request) (int, libhttp.Header, interface{}, error) {
+	cache.Purge()
+	return libhttp.StatusNoContent, nil, nil, nil
+}
+
 func (self *HttpServer) getStats(u *url.URL, h libhttp.Header, req *Request) (int, libhttp.Header, metrics.Registry, error) {
 	return libhttp.StatusOK, nil, stats.NameServerStats, nil
 }
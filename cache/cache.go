@@ -0,0 +1,525 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cache
+
+import (
+	"container/list"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/stats"
+)
+
+// A cached zone lookup, err is sql.ErrNoRows for names that are no zone.
+type zoneEntry struct {
+	zone    db.Zone
+	err     error
+	expires time.Time
+}
+
+// A cached RRSet or name existence lookup within a zone, err is
+// sql.ErrNoRows for RRSets that do not exist.
+type entry struct {
+	rrSet   db.RecordSet
+	exists  bool
+	err     error
+	expires time.Time
+}
+
+// An element of the least recently used list, either a zone lookup by
+// zoneName or a lookup by key within the zone with id zoneId.
+type item struct {
+	zoneName string
+	zoneId   string
+	key      string
+	zone     zoneEntry
+	entry    entry
+}
+
+// A Cache is a db.Backend in front of another one, keeping lookups for at
+// most their TTL. With stale answers enabled it also keeps them past their
+// TTL to answer from while the database is down, as per RFC 8767. Once it
+// holds maxEntries lookups the least recently used ones make room.
+type Cache struct {
+	source      db.Backend
+	lock        sync.RWMutex
+	enabled     bool
+	maxTtl      time.Duration
+	negativeTtl time.Duration
+	maxEntries  int
+
+	stale    bool
+	staleTtl uint32
+	maxStale time.Duration
+	recheck  time.Duration
+	failedAt time.Time
+
+	zones   map[string]*list.Element
+	records map[string]map[string]*list.Element
+	lru     *list.List
+}
+
+var cache = NewCache(&config.Configuration{}, nil)
+
+// Set up the query cache in front of source from the configuration.
+func Setup(cfg *config.Configuration, source db.Backend) *Cache {
+	cache = NewCache(cfg, source)
+
+	if cache.enabled {
+		log.Info("Caching query results for up to %s", cache.maxTtl)
+	}
+	if cache.stale {
+		log.Info("Serving stale data for up to %s while the database is down", cache.maxStale)
+	}
+
+	return cache
+}
+
+func NewCache(cfg *config.Configuration, source db.Backend) *Cache {
+	c := &Cache{
+		source:      source,
+		enabled:     cfg.CacheEnabled,
+		maxTtl:      time.Duration(cfg.CacheMaxTtl) * time.Second,
+		negativeTtl: time.Duration(cfg.CacheNegativeTtl) * time.Second,
+		maxEntries:  cfg.CacheMaxEntries,
+		stale:       cfg.CacheServeStale,
+		staleTtl:    uint32(cfg.CacheStaleTtl),
+		maxStale:    time.Duration(cfg.CacheMaxStale) * time.Second,
+		recheck:     time.Duration(cfg.CacheStaleRecheck) * time.Second,
+		zones:       make(map[string]*list.Element),
+		records:     make(map[string]map[string]*list.Element),
+		lru:         list.New(),
+	}
+
+	if c.maxTtl <= 0 {
+		c.maxTtl = 60 * time.Second
+	}
+	if c.negativeTtl <= 0 {
+		c.negativeTtl = 30 * time.Second
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = 100000
+	}
+	// RFC 8767 recommends 30 second stale TTLs, keeping data for 1 to 3
+	// days and retrying the source every 30 seconds
+	if c.staleTtl <= 0 {
+		c.staleTtl = 30
+	}
+	if c.maxStale <= 0 {
+		c.maxStale = 24 * time.Hour
+	}
+	if c.recheck <= 0 {
+		c.recheck = 30 * time.Second
+	}
+
+	return c
+}
+
+var (
+	purgeLock     sync.RWMutex
+	purgeHandlers []func(zoneName string)
+)
+
+// Register a function to call after a zone is purged, with an empty name
+// when everything is. Backends holding zones in memory reload them.
+func OnPurge(fn func(zoneName string)) {
+	purgeLock.Lock()
+	defer purgeLock.Unlock()
+
+	purgeHandlers = append(purgeHandlers, fn)
+}
+
+// Drop everything cached for a zone.
+func PurgeZone(zoneName string) {
+	cache.PurgeZone(zoneName)
+	purged(zoneName)
+}
+
+// Drop everything cached.
+func Purge() {
+	cache.Purge()
+	purged("")
+}
+
+func purged(zoneName string) {
+	purgeLock.RLock()
+	defer purgeLock.RUnlock()
+
+	for _, fn := range purgeHandlers {
+		fn(zoneName)
+	}
+}
+
+// Look up a zone by name. When the zone is fetched again and its serial
+// has changed, everything cached for it is dropped.
+func (c *Cache) GetZoneByName(zoneName string) (zone db.Zone, err error) {
+	if !c.enabled && !c.stale {
+		return c.source.GetZoneByName(zoneName)
+	}
+
+	e, ok := c.getZone(zoneName)
+	if ok && c.enabled && time.Now().Before(e.expires) {
+		stats.AddToMeter("cache.hit", 1)
+		return e.zone, e.err
+	}
+	if ok && c.usable(e.expires) && c.isDown() {
+		return c.staleZone(e)
+	}
+	stats.AddToMeter("cache.miss", 1)
+
+	zone, err = c.source.GetZoneByName(zoneName)
+	if err != nil && err != sql.ErrNoRows {
+		c.failed(err)
+		if ok && c.usable(e.expires) {
+			return c.staleZone(e)
+		}
+		return zone, err
+	}
+	c.recovered()
+
+	ttl := c.maxTtl
+	if err == sql.ErrNoRows {
+		ttl = c.negativeTtl
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ok && e.err == nil && (err != nil || e.zone.Serial != zone.Serial) {
+		log.Debug("Zone %s changed, purging it from the cache", zoneName)
+		c.dropRecords(e.zone.Id)
+	}
+	c.putZone(zoneName, zoneEntry{zone: zone, err: err, expires: time.Now().Add(ttl)})
+
+	return zone, err
+}
+
+// Look up a RRSet, caching it for its TTL or the zone minimum when it does
+// not exist, bounded by the configured maximums.
+func (c *Cache) GetRecordSet(zone db.Zone, rrName string, rrType string) (rrSet db.RecordSet, err error) {
+	if !c.enabled && !c.stale {
+		return c.source.GetRecordSet(zone, rrName, rrType)
+	}
+
+	key := rrName + "/" + rrType
+
+	e, ok := c.get(zone, key)
+	if ok && (c.isFresh(e) || c.usable(e.expires) && c.isDown()) {
+		return c.entryRecordSet(e)
+	}
+	stats.AddToMeter("cache.miss", 1)
+
+	rrSet, err = c.source.GetRecordSet(zone, rrName, rrType)
+	if err != nil && err != sql.ErrNoRows {
+		c.failed(err)
+		if ok && c.usable(e.expires) {
+			return c.entryRecordSet(e)
+		}
+		return rrSet, err
+	}
+	c.recovered()
+
+	if err == sql.ErrNoRows {
+		c.put(zone, key, entry{err: err}, c.negativeTtlFor(zone))
+	} else {
+		ttl := zone.Ttl
+		if rrSet.Ttl.Valid {
+			ttl = uint32(rrSet.Ttl.Int64)
+		}
+
+		c.put(zone, key, entry{rrSet: rrSet}, time.Duration(ttl)*time.Second)
+	}
+
+	return rrSet, err
+}
+
+// Check whether a name exists in a zone, caching the answer.
+func (c *Cache) NameExists(zone db.Zone, rrName string) (exists bool, err error) {
+	if !c.enabled && !c.stale {
+		return c.source.NameExists(zone, rrName)
+	}
+
+	key := rrName + "/exists"
+
+	e, ok := c.get(zone, key)
+	if ok && c.isFresh(e) {
+		stats.AddToMeter("cache.hit", 1)
+		return e.exists, nil
+	}
+	if ok && c.usable(e.expires) && c.isDown() {
+		stats.AddToMeter("cache.stale", 1)
+		return e.exists, nil
+	}
+	stats.AddToMeter("cache.miss", 1)
+
+	exists, err = c.source.NameExists(zone, rrName)
+	if err != nil {
+		c.failed(err)
+		if ok && c.usable(e.expires) {
+			stats.AddToMeter("cache.stale", 1)
+			return e.exists, nil
+		}
+		return exists, err
+	}
+	c.recovered()
+
+	ttl := time.Duration(zone.Ttl) * time.Second
+	if !exists {
+		ttl = c.negativeTtlFor(zone)
+	}
+	c.put(zone, key, entry{exists: exists}, ttl)
+
+	return exists, nil
+}
+
+// Zones are listed straight from the source.
+func (c *Cache) GetZones() ([]db.Zone, error) {
+	return c.source.GetZones()
+}
+
+// Zones are iterated straight from the source, as transfers must not see
+// stale data.
+func (c *Cache) IterateZoneRecordSets(zone db.Zone, notType string, fn func(db.RecordSet) error) error {
+	return c.source.IterateZoneRecordSets(zone, notType, fn)
+}
+
+func (c *Cache) PurgeZone(zoneName string) {
+	zoneName = strings.ToLower(zoneName)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.zones[zoneName]; ok {
+		c.dropRecords(el.Value.(*item).zone.zone.Id)
+		c.remove(el)
+	}
+	stats.AddToMeter("cache.purge", 1)
+}
+
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.zones = make(map[string]*list.Element)
+	c.records = make(map[string]map[string]*list.Element)
+	c.lru.Init()
+	stats.AddToMeter("cache.purge", 1)
+}
+
+// Get a zone lookup, expired or not.
+func (c *Cache) getZone(zoneName string) (e zoneEntry, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.zones[zoneName]
+	if !ok {
+		return e, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*item).zone, true
+}
+
+// Get an entry of a zone, expired or not.
+func (c *Cache) get(zone db.Zone, key string) (e entry, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.records[zone.Id][key]
+	if !ok {
+		return e, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*item).entry, true
+}
+
+// Whether an entry may be answered from without asking the database.
+func (c *Cache) isFresh(e entry) bool {
+	return c.enabled && time.Now().Before(e.expires)
+}
+
+// Whether an entry expiring at expires may still be served stale.
+func (c *Cache) usable(expires time.Time) bool {
+	return c.stale && time.Now().Before(expires.Add(c.maxStale))
+}
+
+// Answer from an entry, stale ones with a capped TTL so clients come back
+// soon once the database returns.
+func (c *Cache) entryRecordSet(e entry) (rrSet db.RecordSet, err error) {
+	if c.isFresh(e) {
+		stats.AddToMeter("cache.hit", 1)
+	} else {
+		stats.AddToMeter("cache.stale", 1)
+		if e.err == nil && (!e.rrSet.Ttl.Valid || e.rrSet.Ttl.Int64 > int64(c.staleTtl)) {
+			e.rrSet.Ttl = sql.NullInt64{Int64: int64(c.staleTtl), Valid: true}
+		}
+	}
+
+	return e.rrSet, e.err
+}
+
+// Answer from a stale zone, capping the TTLs it hands out.
+func (c *Cache) staleZone(e zoneEntry) (zone db.Zone, err error) {
+	stats.AddToMeter("cache.stale", 1)
+
+	zone = e.zone
+	if zone.Ttl > c.staleTtl {
+		zone.Ttl = c.staleTtl
+	}
+	if zone.Minimum > int(c.staleTtl) {
+		zone.Minimum = int(c.staleTtl)
+	}
+	return zone, e.err
+}
+
+// Whether the database failed recently enough that it is not worth asking
+// again yet.
+func (c *Cache) isDown() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return !c.failedAt.IsZero() && time.Since(c.failedAt) < c.recheck
+}
+
+// Note that the database failed.
+func (c *Cache) failed(err error) {
+	if !c.stale {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.failedAt.IsZero() {
+		log.Warn("Database unavailable, serving stale data: %s", err)
+		stats.SetGauge("cache.stale.active", 1)
+	}
+	c.failedAt = time.Now()
+	stats.AddToMeter("cache.db.failed", 1)
+}
+
+// Note that the database answered, ending stale mode.
+func (c *Cache) recovered() {
+	if !c.stale {
+		return
+	}
+
+	c.lock.RLock()
+	failed := !c.failedAt.IsZero()
+	c.lock.RUnlock()
+
+	if !failed {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.failedAt.IsZero() {
+		return
+	}
+	log.Info("Database available again, no longer serving stale data")
+	c.failedAt = time.Time{}
+	stats.SetGauge("cache.stale.active", 0)
+	stats.AddToMeter("cache.db.recovered", 1)
+}
+
+// Store a zone lookup, the lock must be held.
+func (c *Cache) putZone(zoneName string, e zoneEntry) {
+	if el, ok := c.zones[zoneName]; ok {
+		el.Value.(*item).zone = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.zones[zoneName] = c.lru.PushFront(&item{zoneName: zoneName, zone: e})
+	c.trim()
+}
+
+// Store an entry of a zone for ttl, bounded by the maximum TTL.
+func (c *Cache) put(zone db.Zone, key string, e entry, ttl time.Duration) {
+	if ttl > c.maxTtl {
+		ttl = c.maxTtl
+	}
+	e.expires = time.Now().Add(ttl)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entries, ok := c.records[zone.Id]
+	if !ok {
+		entries = make(map[string]*list.Element)
+		c.records[zone.Id] = entries
+	}
+
+	if el, ok := entries[key]; ok {
+		el.Value.(*item).entry = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	entries[key] = c.lru.PushFront(&item{zoneId: zone.Id, key: key, entry: e})
+	c.trim()
+}
+
+// Drop the least recently used lookups until there are at most maxEntries.
+func (c *Cache) trim() {
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		stats.AddToMeter("cache.evicted", 1)
+	}
+}
+
+// Drop a lookup.
+func (c *Cache) remove(el *list.Element) {
+	it := c.lru.Remove(el).(*item)
+	if it.zoneName != "" {
+		delete(c.zones, it.zoneName)
+		return
+	}
+
+	entries := c.records[it.zoneId]
+	delete(entries, it.key)
+	if len(entries) == 0 {
+		delete(c.records, it.zoneId)
+	}
+}
+
+// Drop the lookups within a zone.
+func (c *Cache) dropRecords(zoneId string) {
+	for _, el := range c.records[zoneId] {
+		c.lru.Remove(el)
+	}
+	delete(c.records, zoneId)
+}
+
+// How long to cache a negative answer, the zone minimum as per RFC 2308
+// bounded by the configured maximum.
+func (c *Cache) negativeTtlFor(zone db.Zone) time.Duration {
+	ttl := time.Duration(zone.Minimum) * time.Second
+	if ttl <= 0 || ttl > c.negativeTtl {
+		ttl = c.negativeTtl
+	}
+	return ttl
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/stats"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	stats.NameServerStats = metrics.NewRegistry()
+
+	c := NewCache(&config.Configuration{CacheEnabled: true, CacheMaxEntries: 2}, nil)
+	zone := db.Zone{Id: "1", Name: "example.org."}
+
+	c.put(zone, "a", entry{exists: true}, time.Minute)
+	c.put(zone, "b", entry{exists: true}, time.Minute)
+	c.get(zone, "a")
+	c.put(zone, "c", entry{exists: true}, time.Minute)
+
+	if _, ok := c.get(zone, "b"); ok {
+		t.Errorf("expected the least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(zone, key); !ok {
+			t.Errorf("expected %s to be kept", key)
+		}
+	}
+	if c.lru.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", c.lru.Len())
+	}
+}
+
+func TestEvictZones(t *testing.T) {
+	stats.NameServerStats = metrics.NewRegistry()
+
+	c := NewCache(&config.Configuration{CacheEnabled: true, CacheMaxEntries: 2}, nil)
+	zone := db.Zone{Id: "1", Name: "example.org."}
+
+	c.putZone("example.org.", zoneEntry{zone: zone})
+	c.put(zone, "a", entry{exists: true}, time.Minute)
+	c.putZone("example.com.", zoneEntry{})
+
+	if _, ok := c.getZone("example.org."); ok {
+		t.Errorf("expected the zone lookup to be evicted")
+	}
+
+	c.PurgeZone("example.com.")
+	if c.lru.Len() != 1 {
+		t.Errorf("expected 1 entry after purging, got %d", c.lru.Len())
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"sync"
 
 	log "code.google.com/p/log4go"
@@ -40,6 +41,9 @@ type ApiConfig struct {
 }
 
 type StorageConfig struct {
+	// "mysql", "postgres", "sqlite3" or "zonefile", taken from the scheme
+	// of DSN when not set
+	Driver  string
 	DSN     string
 	MaxIdle int
 	MaxOpen int
@@ -63,6 +67,71 @@ type NameServerConfig struct {
 	Secret        string
 	LogQuery      bool
 	CompressQuery bool
+	MaxUdpSize    int
+	// "passthrough" queries the database, "memory" serves a copy of every
+	// zone held in memory and reloaded every ReloadInterval seconds
+	Mode           string
+	ReloadInterval int
+}
+
+// Who may transfer a zone: clients within the Allow networks, signing with
+// Key when it is set. Zones with Ixfr set are journaled from the start,
+// others only once a secondary asks for an IXFR.
+type TransferZoneConfig struct {
+	Name  string
+	Allow []string
+	Key   string
+	Ixfr  bool
+}
+
+type TransferConfig struct {
+	Allow []string
+	Key   string
+	Zone  []TransferZoneConfig
+}
+
+// A TSIG key, usable for any zone unless bound to some with Zones.
+type TsigConfig struct {
+	Name      string
+	Algorithm string
+	Secret    string
+	Zones     []string
+}
+
+// Where to send NOTIFY messages for a zone.
+type NotifyZoneConfig struct {
+	Name    string
+	Targets []string
+}
+
+type NotifyConfig struct {
+	Targets  []string
+	Key      string
+	Retries  int
+	Timeout  int
+	Interval int
+	Zone     []NotifyZoneConfig
+}
+
+// A zone we serve as a secondary, transferring it from Primaries signed
+// with Key when it is set.
+type SecondaryConfig struct {
+	Name      string
+	Primaries []string
+	Key       string
+}
+
+type CacheConfig struct {
+	Enabled     bool
+	MaxTtl      int
+	NegativeTtl int
+	MaxEntries  int
+	// Answer from expired entries for up to MaxStale seconds while the
+	// database is down, with StaleTtl TTLs, retrying it every StaleRecheck
+	ServeStale   bool
+	StaleTtl     int
+	MaxStale     int
+	StaleRecheck int
 }
 
 type TomlConfiguration struct {
@@ -71,12 +140,18 @@ type TomlConfiguration struct {
 	Influx     InfluxDbConfig
 	Logging    LoggingConfig
 	NameServer NameServerConfig
+	Transfer   TransferConfig
+	Tsig       []TsigConfig
+	Notify     NotifyConfig
+	Cache      CacheConfig
+	Secondary  []SecondaryConfig
 }
 
 type Configuration struct {
 	ApiServerBind string
 	ApiServerPort int
 
+	StorageDriver  string
 	StorageDSN     string
 	StorageMaxIdle int
 	StorageMaxOpen int
@@ -89,11 +164,38 @@ type Configuration struct {
 	LogLevel string
 	LogFile  string
 
-	NameServerBind   string
-	NameServerPort   int
-	NameServerSecret string
-	LogQuery         bool
-	CompressQuery    bool
+	NameServerBind           string
+	NameServerPort           int
+	NameServerSecret         string
+	NameServerMaxUdpSize     int
+	NameServerMode           string
+	NameServerReloadInterval int
+	LogQuery                 bool
+	CompressQuery            bool
+
+	TransferAllow []string
+	TransferKey   string
+	TransferZones []TransferZoneConfig
+
+	TsigKeys []TsigConfig
+
+	NotifyTargets  []string
+	NotifyKey      string
+	NotifyRetries  int
+	NotifyTimeout  int
+	NotifyInterval int
+	NotifyZones    []NotifyZoneConfig
+
+	CacheEnabled      bool
+	CacheMaxTtl       int
+	CacheNegativeTtl  int
+	CacheMaxEntries   int
+	CacheServeStale   bool
+	CacheStaleTtl     int
+	CacheMaxStale     int
+	CacheStaleRecheck int
+
+	SecondaryZones []SecondaryConfig
 }
 
 func LoadConfiguration(fileName string) (*Configuration, error) {
@@ -133,6 +235,7 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		ApiServerBind: tomlConfiguration.Api.Bind,
 		ApiServerPort: tomlConfiguration.Api.Port,
 
+		StorageDriver:  tomlConfiguration.Storage.Driver,
 		StorageDSN:     tomlConfiguration.Storage.DSN,
 		StorageMaxIdle: tomlConfiguration.Storage.MaxIdle,
 		StorageMaxOpen: tomlConfiguration.Storage.MaxOpen,
@@ -145,11 +248,38 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		LogFile:  tomlConfiguration.Logging.File,
 		LogLevel: tomlConfiguration.Logging.Level,
 
-		NameServerBind:   tomlConfiguration.NameServer.Bind,
-		NameServerPort:   tomlConfiguration.NameServer.Port,
-		NameServerSecret: tomlConfiguration.NameServer.Secret,
-		LogQuery:         tomlConfiguration.NameServer.LogQuery,
-		CompressQuery:    tomlConfiguration.NameServer.CompressQuery,
+		NameServerBind:           tomlConfiguration.NameServer.Bind,
+		NameServerPort:           tomlConfiguration.NameServer.Port,
+		NameServerSecret:         tomlConfiguration.NameServer.Secret,
+		NameServerMaxUdpSize:     tomlConfiguration.NameServer.MaxUdpSize,
+		NameServerMode:           tomlConfiguration.NameServer.Mode,
+		NameServerReloadInterval: tomlConfiguration.NameServer.ReloadInterval,
+		LogQuery:                 tomlConfiguration.NameServer.LogQuery,
+		CompressQuery:            tomlConfiguration.NameServer.CompressQuery,
+
+		TransferAllow: tomlConfiguration.Transfer.Allow,
+		TransferKey:   tomlConfiguration.Transfer.Key,
+		TransferZones: tomlConfiguration.Transfer.Zone,
+
+		TsigKeys: tomlConfiguration.Tsig,
+
+		NotifyTargets:  tomlConfiguration.Notify.Targets,
+		NotifyKey:      tomlConfiguration.Notify.Key,
+		NotifyRetries:  tomlConfiguration.Notify.Retries,
+		NotifyTimeout:  tomlConfiguration.Notify.Timeout,
+		NotifyInterval: tomlConfiguration.Notify.Interval,
+		NotifyZones:    tomlConfiguration.Notify.Zone,
+
+		CacheEnabled:      tomlConfiguration.Cache.Enabled,
+		CacheMaxTtl:       tomlConfiguration.Cache.MaxTtl,
+		CacheNegativeTtl:  tomlConfiguration.Cache.NegativeTtl,
+		CacheMaxEntries:   tomlConfiguration.Cache.MaxEntries,
+		CacheServeStale:   tomlConfiguration.Cache.ServeStale,
+		CacheStaleTtl:     tomlConfiguration.Cache.StaleTtl,
+		CacheMaxStale:     tomlConfiguration.Cache.MaxStale,
+		CacheStaleRecheck: tomlConfiguration.Cache.StaleRecheck,
+
+		SecondaryZones: tomlConfiguration.Secondary,
 	}
 	return config, err
 }
@@ -180,6 +310,38 @@ func (self *Configuration) ApiServerListen() string {
 	return fmt.Sprintf("%s:%d", self.ApiServerBind, self.ApiServerPort)
 }
 
+// The database driver and the DSN to hand it. A postgres:// or
+// postgresql:// DSN selects PostgreSQL, a sqlite:// one or a file: URI
+// SQLite, a zonefile:// one a directory of zone files and a mysql:// one
+// MySQL, which is the default for plain DSNs.
+func (self *Configuration) StorageDriverDSN() (driver string, dsn string) {
+	dsn = self.StorageDSN
+
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		driver = "postgres"
+	case strings.HasPrefix(dsn, "sqlite://"):
+		driver = "sqlite3"
+		dsn = strings.TrimPrefix(dsn, "sqlite://")
+	case strings.HasPrefix(dsn, "file:"):
+		driver = "sqlite3"
+	case strings.HasPrefix(dsn, "zonefile://"):
+		driver = "zonefile"
+		dsn = strings.TrimPrefix(dsn, "zonefile://")
+	case strings.HasPrefix(dsn, "mysql://"):
+		driver = "mysql"
+		dsn = strings.TrimPrefix(dsn, "mysql://")
+	default:
+		driver = "mysql"
+	}
+
+	if self.StorageDriver != "" {
+		driver = self.StorageDriver
+	}
+
+	return driver, dsn
+}
+
 func (self *Configuration) NameServerListen() string {
 	if self.NameServerPort <= 0 {
 		return ":5053"
@@ -187,3 +349,23 @@ func (self *Configuration) NameServerListen() string {
 
 	return fmt.Sprintf("%s:%d", self.NameServerBind, self.NameServerPort)
 }
+
+// Whether zones are served from memory rather than the database.
+func (self *Configuration) InMemory() bool {
+	return self.NameServerMode == "memory"
+}
+
+// The largest UDP response we are willing to send to EDNS0 clients.
+func (self *Configuration) MaxUdpSize() uint16 {
+	if self.NameServerMaxUdpSize <= 0 {
+		return 4096
+	}
+	if self.NameServerMaxUdpSize < 512 {
+		return 512
+	}
+	if self.NameServerMaxUdpSize > 65535 {
+		return 65535
+	}
+
+	return uint16(self.NameServerMaxUdpSize)
+}
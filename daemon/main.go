@@ -28,10 +28,16 @@ import (
 	"syscall"
 
 	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/cache"
 	"github.com/ekarlso/gomdns/config"
 	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/memory"
+	"github.com/ekarlso/gomdns/nameserver"
+	"github.com/ekarlso/gomdns/notify"
+	"github.com/ekarlso/gomdns/secondary"
 	"github.com/ekarlso/gomdns/server"
 	"github.com/ekarlso/gomdns/stats"
+	"github.com/ekarlso/gomdns/zonefile"
 )
 
 var (
@@ -85,6 +91,44 @@ func setupLogging(loggingLevel, logFile string) {
 	log.Info("Redirectoring logging to %s", logFile)
 }
 
+// Set up the storage zones are served from and what answers queries from
+// it, returning the backend served from without any cache in front.
+func setupBackend(cfg *config.Configuration) (served db.Backend) {
+	if driver, _ := cfg.StorageDriverDSN(); driver == "zonefile" {
+		backend, err := zonefile.Setup(cfg)
+		if err != nil {
+			log.Warn("Error loading zone files: %s", err)
+			os.Exit(1)
+		}
+
+		served = secondary.Wrap(backend)
+		nameserver.SetBackend(served, served)
+		return served
+	}
+
+	// Setup db access
+	store, err := db.Setup(cfg)
+	if err != nil || store.CheckDB() != true {
+		log.Warn("Error verifying database connectivity, see above for errors")
+		os.Exit(1)
+	}
+
+	if cfg.InMemory() {
+		memStore, err := memory.Setup(cfg, store)
+		if err != nil {
+			log.Warn("Error loading zones into memory: %s", err)
+			os.Exit(1)
+		}
+		served = secondary.Wrap(memStore)
+		nameserver.SetBackend(served, served)
+	} else {
+		served = secondary.Wrap(store)
+		nameserver.SetBackend(secondary.Wrap(cache.Setup(cfg, store)), served)
+	}
+
+	return served
+}
+
 func main() {
 	fileName := flag.String("config", "config.toml", "Config file")
 	flag.StringVar(&connection, "connection", "", "Connection string to use for Database")
@@ -92,7 +136,7 @@ func main() {
 	flag.IntVar(&nsPort, "nameserver_port", 0, "Addr to listen at")
 	flag.StringVar(&apiBind, "api_bind", "", "Addr to listen at")
 	flag.IntVar(&apiPort, "api_port", 0, "Addr to listen at")
-	flag.StringVar(&tsig, "tsig", "", "use MD5 hmac tsig: keyname:base64")
+	flag.StringVar(&tsig, "tsig", "", "use hmac tsig with any supported algorithm: keyname:base64")
 	stdout := flag.Bool("stdout", false, "Log to stdout overriding the configuration")
 	syslog := flag.String("syslog", "", "Log to syslog facility overriding the configuration")
 
@@ -125,6 +169,10 @@ func main() {
 		cfg.StorageDSN = connection
 	}
 
+	if tsig != "" {
+		cfg.NameServerSecret = tsig
+	}
+
 	if *stdout {
 		cfg.LogFile = "stdout"
 	}
@@ -138,17 +186,17 @@ func main() {
 	log.Info("Database is at connection %s", cfg.StorageDSN)
 
 	stats.Setup(cfg)
+	nameserver.SetupJournal(cfg)
 
-	db.Setup(cfg)
-	// Setup db access
-	if db.CheckDB(cfg.StorageDSN) != true {
-		log.Warn("Error verifying database connectivity, see above for errors")
-		os.Exit(1)
-	}
+	served := setupBackend(cfg)
+	notify.Setup(cfg, served)
 
-	srv, err := server.NewServer(cfg)
+	srv, err := server.NewServer(cfg, served)
 	srv.ListenAndServe()
 
+	// Transfers may need the TSIG keys the name server has loaded by now
+	secondary.Setup(cfg)
+
 	sig := make(chan os.Signal)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
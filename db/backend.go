@@ -0,0 +1,33 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package db
+
+// A Backend is a store zones are served from. Lookups of zones and RRSets
+// that do not exist fail with sql.ErrNoRows.
+type Backend interface {
+	GetZoneByName(zoneName string) (Zone, error)
+	GetZones() ([]Zone, error)
+	GetRecordSet(zone Zone, rrName string, rrType string) (RecordSet, error)
+	// Whether a name owns RRSets or is an empty non-terminal above names
+	// that do
+	NameExists(zone Zone, rrName string) (bool, error)
+	// Stream the RRSets of a zone, except those of notType, to fn
+	IterateZoneRecordSets(zone Zone, notType string, fn func(RecordSet) error) error
+}
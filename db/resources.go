@@ -21,17 +21,13 @@ package db
 
 import (
 	"database/sql"
-	"strconv"
+	"errors"
 	"strings"
 )
 
-func parseUint16(s string) uint16 {
-	u, _ := strconv.ParseUint(s, 10, 0)
-	return uint16(u)
-}
-func parseUint32(s string) uint32 {
-	u, _ := strconv.ParseUint(s, 10, 0)
-	return uint32(u)
+// Escape the LIKE metacharacters in s so it is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
 }
 
 type Soa struct {
@@ -109,26 +105,153 @@ type Record struct {
 }
 
 // Extract weight, port and dname from a srv string.
-func (s Record) ExtractSrv() Srv {
-	data := strings.Split(s.Data, " ")
+func (s Record) ExtractSrv() (srv Srv, err error) {
+	data := strings.Fields(s.Data)
+	if len(data) != 3 {
+		return srv, s.invalid(errors.New("expected weight, port and target"))
+	}
+
+	v := &validator{}
+	srv = Srv{
+		Weight: v.uint16(data[0]),
+		Port:   v.uint16(data[1]),
+		Target: v.name(data[2]),
+	}
+
+	if v.err != nil {
+		return Srv{}, s.invalid(v.err)
+	}
+	return srv, nil
+}
+
+// Extract the fields from a soa string.
+func (s Record) ExtractSOA() (soa Soa, err error) {
+	data := strings.Fields(s.Data)
+	if len(data) != 7 {
+		return soa, s.invalid(errors.New("expected mname, rname, serial, refresh, retry, expire and minimum"))
+	}
+
+	v := &validator{}
+	soa = Soa{
+		Ns:      v.name(data[0]),
+		Mbox:    v.name(data[1]),
+		Serial:  v.uint32(data[2]),
+		Refresh: v.uint32(data[3]),
+		Retry:   v.uint32(data[4]),
+		Expire:  v.uint32(data[5]),
+		Minttl:  v.uint32(data[6]),
+	}
+
+	if v.err != nil {
+		return Soa{}, s.invalid(v.err)
+	}
+	return soa, nil
+}
+
+// The longest character-string that fits on the wire.
+const maxTxtString = 255
+
+// Extract the character-strings of TXT or SPF data. Zone file style data,
+// one or more quoted strings with \X and \DDD escapes, is split into its
+// strings, while data without any quotes is taken as a single string.
+// Strings longer than 255 bytes are split up as they cannot be sent as is.
+func (s Record) ExtractTxt() (txt []string, err error) {
+	var strs []string
+
+	if !strings.Contains(s.Data, "\"") {
+		strs = []string{s.Data}
+	} else {
+		strs, err = splitTxt(s.Data)
+		if err != nil {
+			return nil, s.invalid(err)
+		}
+	}
 
-	return Srv{
-		Weight: parseUint16(data[0]),
-		Port:   parseUint16(data[1]),
-		Target: data[2],
+	for _, str := range strs {
+		for len(str) > maxTxtString {
+			txt = append(txt, str[:maxTxtString])
+			str = str[maxTxtString:]
+		}
+		txt = append(txt, str)
+	}
+
+	return txt, nil
+}
+
+// Split zone file style data into its unescaped character-strings.
+func splitTxt(data string) (strs []string, err error) {
+	i := 0
+
+	for {
+		for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+			i++
+		}
+		if i == len(data) {
+			return strs, nil
+		}
+
+		quoted := data[i] == '"'
+		if quoted {
+			i++
+		}
+
+		var str []byte
+		for {
+			if i == len(data) {
+				if quoted {
+					return nil, errors.New("unterminated quoted string in " + data)
+				}
+				break
+			}
+
+			c := data[i]
+			if quoted && c == '"' {
+				i++
+				break
+			}
+			if !quoted && (c == ' ' || c == '\t' || c == '"') {
+				break
+			}
+
+			if c == '\\' {
+				c, i, err = unescapeTxt(data, i)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				i++
+			}
+			str = append(str, c)
+		}
+
+		strs = append(strs, string(str))
 	}
 }
 
-func (s Record) ExtractSOA() Soa {
-	data := strings.Split(s.Data, " ")
+// Unescape the \X or \DDD sequence at data[i], returning the byte and the
+// index after the sequence.
+func unescapeTxt(data string, i int) (c byte, next int, err error) {
+	if i+1 >= len(data) {
+		return 0, 0, errors.New("dangling escape in " + data)
+	}
 
-	return Soa{
-		Ns:      data[0],
-		Mbox:    data[1],
-		Serial:  parseUint32(data[2]),
-		Refresh: parseUint32(data[3]),
-		Retry:   parseUint32(data[4]),
-		Expire:  parseUint32(data[5]),
-		Minttl:  parseUint32(data[6]),
+	if !isDigit(data[i+1]) {
+		return data[i+1], i + 2, nil
+	}
+
+	if i+3 >= len(data) {
+		return 0, 0, errors.New("short \\DDD escape in " + data)
+	}
+	if !isDigit(data[i+2]) || !isDigit(data[i+3]) {
+		return 0, 0, errors.New("bad \\DDD escape in " + data)
 	}
+
+	n := int(data[i+1]-'0')*100 + int(data[i+2]-'0')*10 + int(data[i+3]-'0')
+	if n > 255 {
+		return 0, 0, errors.New("bad \\DDD escape in " + data)
+	}
+
+	return byte(n), i + 4, nil
 }
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractTxt(t *testing.T) {
+	long := strings.Repeat("a", 300)
+
+	tests := []struct {
+		data string
+		txt  []string
+	}{
+		{`v=spf1 -all`, []string{"v=spf1 -all"}},
+		{`raw \065 back\slash`, []string{`raw \065 back\slash`}},
+		{`bare \"escaped\" quotes`, []string{"bare", `"escaped"`, "quotes"}},
+		{`"v=spf1 -all"`, []string{"v=spf1 -all"}},
+		{`"one" "two"`, []string{"one", "two"}},
+		{` "one"	"two" `, []string{"one", "two"}},
+		{`"" "x"`, []string{"", "x"}},
+		{`"say \"hi\""`, []string{`say "hi"`}},
+		{`"back\\slash"`, []string{`back\slash`}},
+		{`"\065\066\067"`, []string{"ABC"}},
+		{`"\255"`, []string{"\xff"}},
+		{`"\000"`, []string{"\x00"}},
+		{`"quoted" bare\032word`, []string{"quoted", "bare word"}},
+		{`"a"b`, []string{"a", "b"}},
+		{long, []string{long[:255], long[255:]}},
+		{`"` + long + `"`, []string{long[:255], long[255:]}},
+		{`"` + strings.Repeat("b", 255) + `"`, []string{strings.Repeat("b", 255)}},
+		{`"` + strings.Repeat("c", 510) + `"`, []string{strings.Repeat("c", 255), strings.Repeat("c", 255)}},
+	}
+
+	for _, test := range tests {
+		txt, err := Record{Data: test.data}.ExtractTxt()
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", test.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(txt, test.txt) {
+			t.Errorf("%q: expected %q, got %q", test.data, test.txt, txt)
+		}
+	}
+}
+
+func TestExtractTxtInvalid(t *testing.T) {
+	tests := []string{
+		`"unterminated`,
+		`"one" "two`,
+		`"dangling\`,
+		`"\25"`,
+		`"\2"`,
+		`"\25x"`,
+		`"\256"`,
+		`"\999"`,
+	}
+
+	for _, data := range tests {
+		txt, err := Record{Id: "1", Data: data}.ExtractTxt()
+		if err == nil {
+			t.Errorf("%q: expected an error, got %q", data, txt)
+			continue
+		}
+		if _, ok := err.(*RecordError); !ok {
+			t.Errorf("%q: expected a *RecordError, got %T", data, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package db
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// The part of the Designate schema gomdns reads, for SQLite databases that
+// are not managed by Designate.
+const Schema = `
+CREATE TABLE IF NOT EXISTS domains (
+	id VARCHAR(36) NOT NULL PRIMARY KEY,
+	version INTEGER NOT NULL DEFAULT 1,
+	name VARCHAR(255) NOT NULL UNIQUE,
+	email VARCHAR(255) NOT NULL,
+	ttl INTEGER NOT NULL DEFAULT 3600,
+	serial INTEGER NOT NULL DEFAULT 1,
+	refresh INTEGER NOT NULL DEFAULT 3600,
+	retry INTEGER NOT NULL DEFAULT 600,
+	expire INTEGER NOT NULL DEFAULT 86400,
+	minimum INTEGER NOT NULL DEFAULT 3600
+);
+
+CREATE TABLE IF NOT EXISTS recordsets (
+	id VARCHAR(36) NOT NULL PRIMARY KEY,
+	domain_id VARCHAR(36) NOT NULL REFERENCES domains (id) ON DELETE CASCADE,
+	name VARCHAR(255) NOT NULL,
+	type VARCHAR(8) NOT NULL,
+	ttl INTEGER,
+	UNIQUE (domain_id, name, type)
+);
+
+CREATE INDEX IF NOT EXISTS recordsets_domain_name ON recordsets (domain_id, name);
+
+CREATE TABLE IF NOT EXISTS records (
+	id VARCHAR(36) NOT NULL PRIMARY KEY,
+	domain_id VARCHAR(36) NOT NULL REFERENCES domains (id) ON DELETE CASCADE,
+	recordset_id VARCHAR(36) NOT NULL REFERENCES recordsets (id) ON DELETE CASCADE,
+	data TEXT NOT NULL,
+	priority INTEGER,
+	hash VARCHAR(32) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS records_recordset ON records (recordset_id);
+`
+
+// Create the tables of Schema that do not exist yet.
+func CreateSchema(db *sqlx.DB) (err error) {
+	_, err = db.Exec(Schema)
+	return err
+}
@@ -20,21 +20,48 @@
 package db
 
 import (
+	"database/sql"
+
 	log "code.google.com/p/log4go"
+	"github.com/jmoiron/sqlx"
 )
 
-func GetZoneById(zoneId string) (z Zone, err error) {
-	err = Database.Get(&z, "SELECT id, version, name, email, ttl, serial, refresh, retry, expire, minimum FROM domains WHERE id = ?", zoneId)
+// A SQLBackend serves zones from the Designate schema, the domains,
+// recordsets and records tables, in MySQL, PostgreSQL or SQLite.
+type SQLBackend struct {
+	db *sqlx.DB
+}
 
-	if err != nil {
-		log.Debug("Failed getting zone")
+func NewSQLBackend(db *sqlx.DB) *SQLBackend {
+	return &SQLBackend{db: db}
+}
+
+// Rebind the ? placeholders of a query for the driver.
+func (b *SQLBackend) query(query string) string {
+	return b.db.Rebind(query)
+}
+
+// A LIKE against a pattern escaped with escapeLike. SQLite has no default
+// escape character.
+func (b *SQLBackend) like() string {
+	if b.db.DriverName() == "sqlite3" {
+		return `LIKE ? ESCAPE '\'`
 	}
+	return "LIKE ?"
+}
 
-	return z, err
+// The type column of recordsets to compare against. PostgreSQL keeps it in
+// an enum, which is compared as text so types it does not know are simply
+// not found rather than an error.
+func (b *SQLBackend) typeColumn(column string) string {
+	if b.db.DriverName() == "postgres" {
+		return column + "::text"
+	}
+	return column
 }
 
-func GetZoneByName(zoneName string) (z Zone, err error) {
-	err = Database.Get(&z, "SELECT id, version, name, email, ttl, serial, refresh, retry, expire, minimum FROM domains WHERE name = ?", zoneName)
+func (b *SQLBackend) GetZoneByName(zoneName string) (z Zone, err error) {
+	err = b.db.Get(&z, b.query("SELECT id, version, name, email, ttl, serial, refresh, retry, expire, minimum FROM domains WHERE name = ?"), zoneName)
 
 	if err != nil {
 		log.Debug("Failed getting zone")
@@ -43,38 +70,100 @@ func GetZoneByName(zoneName string) (z Zone, err error) {
 	return z, err
 }
 
-func GetZoneRecordSets(zone Zone, rrType string, notType string) (rrSets []RecordSet, err error) {
-	stmt := "SELECT id, domain_id, name, type, ttl FROM recordsets WHERE domain_id = ?"
-	if rrType != "" {
-		stmt += " AND type = ?"
+func (b *SQLBackend) GetZones() (zones []Zone, err error) {
+	err = b.db.Select(&zones, b.query("SELECT id, version, name, email, ttl, serial, refresh, retry, expire, minimum FROM domains"))
+
+	if err != nil {
+		log.Error("Error fetching zones: %s", err)
 	}
-	if notType != "" {
-		stmt += " AND type != ?"
+
+	return zones, err
+}
+
+// Check whether a name exists in a zone, either because it owns RRSets or
+// because it is an empty non-terminal above names that do.
+func (b *SQLBackend) NameExists(zone Zone, rrName string) (exists bool, err error) {
+	var count int
+
+	err = b.db.Get(&count, b.query("SELECT COUNT(*) FROM recordsets WHERE domain_id = ? AND (name = ? OR name "+b.like()+")"), zone.Id, rrName, "%."+escapeLike(rrName))
+
+	if err != nil {
+		log.Error("Error checking existence of %s in %v", rrName, zone.Id)
+		return false, err
 	}
 
-	err = Database.Select(&rrSets, stmt, zone.Id, notType)
+	return count > 0, err
+}
 
+// A row of a recordset joined with one of its records.
+type recordSetRow struct {
+	RecordSetId string `db:"recordset_id"`
+	DomainId    string `db:"domain_id"`
+	Name        string
+	Type        string
+	Ttl         sql.NullInt64
+	RecordId    string `db:"record_id"`
+	Data        string
+	Priority    sql.NullInt64
+	Hash        string
+}
+
+// Stream the RRSets of a zone, except those of notType, to fn one at a time
+// using a cursor so the zone is never loaded as a whole.
+func (b *SQLBackend) IterateZoneRecordSets(zone Zone, notType string, fn func(RecordSet) error) (err error) {
+	rows, err := b.db.Queryx(b.query("SELECT rs.id AS recordset_id, rs.domain_id, rs.name, rs.type, rs.ttl, r.id AS record_id, r.data, r.priority, r.hash FROM recordsets rs JOIN records r ON r.recordset_id = rs.id WHERE rs.domain_id = ? AND "+b.typeColumn("rs.type")+" != ? ORDER BY rs.id"), zone.Id, notType)
 	if err != nil {
-		log.Error("Error fetching RRSets for %v", zone.Id)
-		log.Debug(err)
-		return rrSets, err
+		log.Error("Error iterating RRSets for %v", zone.Id)
+		return err
 	}
+	defer rows.Close()
+
+	var rrSet RecordSet
+
+	for rows.Next() {
+		var row recordSetRow
 
-	for i, _ := range rrSets {
-		records, err := GetRRSetRecords(rrSets[i])
+		if err = rows.StructScan(&row); err != nil {
+			return err
+		}
 
-		if err != nil {
-			return rrSets, err
+		if row.RecordSetId != rrSet.Id {
+			if rrSet.Id != "" {
+				if err = fn(rrSet); err != nil {
+					return err
+				}
+			}
+
+			rrSet = RecordSet{
+				Id:       row.RecordSetId,
+				DomainId: row.DomainId,
+				Name:     row.Name,
+				Type:     row.Type,
+				Ttl:      row.Ttl,
+			}
 		}
 
-		rrSets[i].Records = records
+		rrSet.Records = append(rrSet.Records, &Record{
+			Id:          row.RecordId,
+			DomainId:    row.DomainId,
+			RecordSetId: row.RecordSetId,
+			Data:        row.Data,
+			Priority:    row.Priority,
+			Hash:        row.Hash,
+		})
 	}
 
-	return rrSets, err
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if rrSet.Id != "" {
+		return fn(rrSet)
+	}
+	return nil
 }
 
-func GetRRSetRecords(rrSet RecordSet) (records []*Record, err error) {
-	err = Database.Select(&records, "SELECT id, domain_id, recordset_id, data, priority, hash FROM records WHERE recordset_id = ?", rrSet.Id)
+func (b *SQLBackend) GetRRSetRecords(rrSet RecordSet) (records []*Record, err error) {
+	err = b.db.Select(&records, b.query("SELECT id, domain_id, recordset_id, data, priority, hash FROM records WHERE recordset_id = ?"), rrSet.Id)
 
 	if err != nil {
 		log.Error("Error fetching records for RRset %s", err)
@@ -83,15 +172,15 @@ func GetRRSetRecords(rrSet RecordSet) (records []*Record, err error) {
 
 }
 
-func GetRecordSet(rrName string, rrType string) (rrSet RecordSet, err error) {
-	err = Database.Get(&rrSet, "SELECT id, domain_id, name, type, ttl from recordsets WHERE name = ? AND type = ?", rrName, rrType)
+func (b *SQLBackend) GetRecordSet(zone Zone, rrName string, rrType string) (rrSet RecordSet, err error) {
+	err = b.db.Get(&rrSet, b.query("SELECT id, domain_id, name, type, ttl from recordsets WHERE domain_id = ? AND name = ? AND "+b.typeColumn("type")+" = ?"), zone.Id, rrName, rrType)
 
 	if err != nil {
 		log.Debug("Failed getting RRSet")
 		return rrSet, err
 	}
 
-	records, err := GetRRSetRecords(rrSet)
+	records, err := b.GetRRSetRecords(rrSet)
 	rrSet.Records = records
 
 	return rrSet, err
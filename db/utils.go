@@ -23,38 +23,46 @@ import (
 	log "code.google.com/p/log4go"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/ekarlso/gomdns/config"
 )
 
-var Database *sqlx.DB
-
-// Connect and return a connection
-func Setup(cfg *config.Configuration) (err error) {
+// Connect and return a backend using the connection
+func Setup(cfg *config.Configuration) (backend *SQLBackend, err error) {
 	log.Info("Connecting to %s", cfg.StorageDSN)
 
-	db, err := sqlx.Open("mysql", cfg.StorageDSN)
+	driver, dsn := cfg.StorageDriverDSN()
+
+	db, err := sqlx.Open(driver, dsn)
 	if err != nil {
 		log.Error(err)
-		return err
+		return nil, err
 	}
 
 	err = db.Ping()
 	if err != nil {
 		log.Error("Error connecting to db %s", err)
-		return err
+		return nil, err
+	}
+
+	if driver == "sqlite3" {
+		if err = CreateSchema(db); err != nil {
+			log.Error("Error creating schema %s", err)
+			return nil, err
+		}
 	}
 
 	db.SetMaxOpenConns(cfg.StorageMaxOpen)
 	db.SetMaxIdleConns(cfg.StorageMaxIdle)
 
-	Database = db
-	return nil
+	return NewSQLBackend(db), nil
 }
 
-// Check that the Database is valid.
-func CheckDB(dsn string) bool {
-	_, err := Database.Exec("SELECT * FROM domains")
+// Check that the database is valid.
+func (b *SQLBackend) CheckDB() bool {
+	_, err := b.db.Exec("SELECT * FROM domains")
 	if err != nil {
 		log.Error(err)
 		return false
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A RecordError is returned when the data of a record can not be parsed.
+type RecordError struct {
+	Id   string
+	Data string
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("invalid record %s (%q): %s", e.Id, e.Data, e.Err)
+}
+
+func (s Record) invalid(err error) *RecordError {
+	return &RecordError{Id: s.Id, Data: s.Data, Err: err}
+}
+
+func parseUint16(s string) (uint16, error) {
+	u, err := strconv.ParseUint(s, 10, 16)
+	return uint16(u), err
+}
+func parseUint32(s string) (uint32, error) {
+	u, err := strconv.ParseUint(s, 10, 32)
+	return uint32(u), err
+}
+
+// Check that s looks like a fully qualified domain name.
+func checkName(s string) error {
+	if s == "" || !strings.HasSuffix(s, ".") {
+		return fmt.Errorf("%q is not a fully qualified name", s)
+	}
+	if strings.ContainsAny(s, " \t\"") || strings.Contains(s, "..") {
+		return fmt.Errorf("%q is not a valid name", s)
+	}
+	return nil
+}
+
+// A validator parses fields, keeping the first error it runs into.
+type validator struct {
+	err error
+}
+
+func (v *validator) uint16(s string) (u uint16) {
+	if v.err == nil {
+		u, v.err = parseUint16(s)
+	}
+	return u
+}
+
+func (v *validator) uint32(s string) (u uint32) {
+	if v.err == nil {
+		u, v.err = parseUint32(s)
+	}
+	return u
+}
+
+func (v *validator) name(s string) string {
+	if v.err == nil {
+		v.err = checkName(s)
+	}
+	return s
+}
+
+// Extract the address of an A record.
+func (s Record) ExtractIPv4() (ip net.IP, err error) {
+	ip = net.ParseIP(s.Data).To4()
+	if ip == nil || strings.Contains(s.Data, ":") {
+		return nil, s.invalid(errors.New("not an IPv4 address"))
+	}
+	return ip, nil
+}
+
+// Extract the address of an AAAA record.
+func (s Record) ExtractIPv6() (ip net.IP, err error) {
+	ip = net.ParseIP(s.Data)
+	if ip == nil || !strings.Contains(s.Data, ":") {
+		return nil, s.invalid(errors.New("not an IPv6 address"))
+	}
+	return ip, nil
+}
+
+// Extract the domain name of a CNAME, NS, MX or PTR record.
+func (s Record) ExtractName() (name string, err error) {
+	if err = checkName(s.Data); err != nil {
+		return "", s.invalid(err)
+	}
+	return s.Data, nil
+}
+
+// Extract the priority of a MX or SRV record.
+func (s Record) ExtractPriority() (priority uint16, err error) {
+	if !s.Priority.Valid {
+		return 0, s.invalid(errors.New("missing priority"))
+	}
+	if s.Priority.Int64 < 0 || s.Priority.Int64 > 0xFFFF {
+		return 0, s.invalid(fmt.Errorf("priority %d out of range", s.Priority.Int64))
+	}
+	return uint16(s.Priority.Int64), nil
+}
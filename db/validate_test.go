@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package db
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestExtractSOA(t *testing.T) {
+	soa, err := Record{Data: "ns1.example.org. admin.example.org. 2014010101 3600 600 86400 300"}.ExtractSOA()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	want := Soa{Ns: "ns1.example.org.", Mbox: "admin.example.org.", Serial: 2014010101, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 300}
+	if soa != want {
+		t.Errorf("expected %+v, got %+v", want, soa)
+	}
+}
+
+func TestExtractSOAInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"ns1.example.org. admin.example.org. 1 3600 600 86400",
+		"ns1.example.org. admin.example.org. 1 3600 600 86400 300 42",
+		"ns1.example.org admin.example.org. 1 3600 600 86400 300",
+		"ns1.example.org. admin..example.org. 1 3600 600 86400 300",
+		"ns1.example.org. admin.example.org. -1 3600 600 86400 300",
+		"ns1.example.org. admin.example.org. 4294967296 3600 600 86400 300",
+		"ns1.example.org. admin.example.org. 1 x 600 86400 300",
+	}
+
+	for _, data := range tests {
+		if soa, err := (Record{Data: data}).ExtractSOA(); err == nil {
+			t.Errorf("%q: expected an error, got %+v", data, soa)
+		}
+	}
+}
+
+func TestExtractSrv(t *testing.T) {
+	srv, err := Record{Data: "10 5060 sip.example.org."}.ExtractSrv()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	want := Srv{Weight: 10, Port: 5060, Target: "sip.example.org."}
+	if srv != want {
+		t.Errorf("expected %+v, got %+v", want, srv)
+	}
+}
+
+func TestExtractSrvInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"10 5060",
+		"0 10 5060 sip.example.org.",
+		"10 65536 sip.example.org.",
+		"-1 5060 sip.example.org.",
+		"10 5060 sip.example.org",
+	}
+
+	for _, data := range tests {
+		if srv, err := (Record{Data: data}).ExtractSrv(); err == nil {
+			t.Errorf("%q: expected an error, got %+v", data, srv)
+		}
+	}
+}
+
+func TestExtractIP(t *testing.T) {
+	tests := []struct {
+		data string
+		v4   bool
+		v6   bool
+	}{
+		{"192.0.2.1", true, false},
+		{"2001:db8::1", false, true},
+		{"::ffff:192.0.2.1", false, true},
+		{"192.0.2.256", false, false},
+		{"192.0.2", false, false},
+		{"example.org.", false, false},
+		{"", false, false},
+	}
+
+	for _, test := range tests {
+		r := Record{Data: test.data}
+		if _, err := r.ExtractIPv4(); (err == nil) != test.v4 {
+			t.Errorf("%q as IPv4: got error %v", test.data, err)
+		}
+		if _, err := r.ExtractIPv6(); (err == nil) != test.v6 {
+			t.Errorf("%q as IPv6: got error %v", test.data, err)
+		}
+	}
+}
+
+func TestExtractName(t *testing.T) {
+	tests := []struct {
+		data  string
+		valid bool
+	}{
+		{"www.example.org.", true},
+		{".", true},
+		{"www.example.org", false},
+		{"", false},
+		{"www..example.org.", false},
+		{"www example.org.", false},
+		{"www\t.example.org.", false},
+		{`"www".example.org.`, false},
+	}
+
+	for _, test := range tests {
+		if _, err := (Record{Data: test.data}).ExtractName(); (err == nil) != test.valid {
+			t.Errorf("%q: got error %v", test.data, err)
+		}
+	}
+}
+
+func TestExtractPriority(t *testing.T) {
+	tests := []struct {
+		priority sql.NullInt64
+		valid    bool
+	}{
+		{sql.NullInt64{Int64: 0, Valid: true}, true},
+		{sql.NullInt64{Int64: 10, Valid: true}, true},
+		{sql.NullInt64{Int64: 65535, Valid: true}, true},
+		{sql.NullInt64{Int64: 65536, Valid: true}, false},
+		{sql.NullInt64{Int64: -1, Valid: true}, false},
+		{sql.NullInt64{}, false},
+	}
+
+	for _, test := range tests {
+		priority, err := Record{Priority: test.priority}.ExtractPriority()
+		if (err == nil) != test.valid {
+			t.Errorf("%v: got error %v", test.priority, err)
+		}
+		if err == nil && int64(priority) != test.priority.Int64 {
+			t.Errorf("%v: got %d", test.priority, priority)
+		}
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	_, err := Record{Id: "42", Data: "bogus"}.ExtractIPv4()
+
+	recordErr, ok := err.(*RecordError)
+	if !ok {
+		t.Fatalf("expected a *RecordError, got %T", err)
+	}
+	if recordErr.Id != "42" || recordErr.Data != "bogus" {
+		t.Errorf("expected the id and data of the record, got %+v", recordErr)
+	}
+}
@@ -0,0 +1,315 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package memory
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/cache"
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/nameserver"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+)
+
+// A zone held in memory: its RRSets keyed by name and type, and every name
+// that exists within it including empty non-terminals.
+type zoneData struct {
+	zone   db.Zone
+	rrSets map[string]db.RecordSet
+	names  map[string]bool
+}
+
+// A Store is a db.Backend holding a copy of every zone of another one in
+// memory, so queries never touch the database.
+type Store struct {
+	source db.Backend
+	lock   sync.RWMutex
+	zones  map[string]*zoneData
+	onLoad []func(zone db.Zone)
+}
+
+// Load every zone of source into memory, and keep reloading zones whose
+// serial changes.
+func Setup(cfg *config.Configuration, source db.Backend) (store *Store, err error) {
+	store = NewStore(source)
+	store.OnLoad(func(zone db.Zone) { nameserver.Snapshot(store, zone) })
+
+	// NOTIFY and purging the cache reload zones right away
+	cache.OnPurge(func(zoneName string) {
+		if zoneName == "" {
+			store.Reload()
+		} else {
+			store.ReloadZone(zoneName)
+		}
+	})
+
+	if err = store.Reload(); err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(cfg.NameServerReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+	go store.Watch(interval)
+
+	return store, nil
+}
+
+func NewStore(source db.Backend) *Store {
+	return &Store{source: source, zones: make(map[string]*zoneData)}
+}
+
+func (s *Store) GetZoneByName(zoneName string) (zone db.Zone, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	data, ok := s.zones[strings.ToLower(zoneName)]
+	if !ok {
+		return zone, sql.ErrNoRows
+	}
+
+	return data.zone, nil
+}
+
+func (s *Store) GetZones() (zones []db.Zone, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, data := range s.zones {
+		zones = append(zones, data.zone)
+	}
+	return zones, nil
+}
+
+func (s *Store) GetRecordSet(zone db.Zone, rrName string, rrType string) (rrSet db.RecordSet, err error) {
+	data := s.zone(zone)
+	if data == nil {
+		return rrSet, sql.ErrNoRows
+	}
+
+	rrSet, ok := data.rrSets[rrSetKey(rrName, rrType)]
+	if !ok {
+		return rrSet, sql.ErrNoRows
+	}
+
+	return rrSet, nil
+}
+
+func (s *Store) NameExists(zone db.Zone, rrName string) (exists bool, err error) {
+	data := s.zone(zone)
+	if data == nil {
+		return false, nil
+	}
+
+	return data.names[strings.ToLower(rrName)], nil
+}
+
+func (s *Store) IterateZoneRecordSets(zone db.Zone, notType string, fn func(db.RecordSet) error) (err error) {
+	data := s.zone(zone)
+	if data == nil {
+		return sql.ErrNoRows
+	}
+
+	for _, rrSet := range data.rrSets {
+		if rrSet.Type == notType {
+			continue
+		}
+
+		if err = fn(rrSet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the data of a zone, as long as it is the one that was looked up.
+func (s *Store) zone(zone db.Zone) *zoneData {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	data, ok := s.zones[strings.ToLower(zone.Name)]
+	if !ok || data.zone.Id != zone.Id {
+		return nil
+	}
+
+	return data
+}
+
+// Bring the store in line with the database, loading zones that are new
+// or whose serial changed and dropping those that are gone.
+func (s *Store) Reload() (err error) {
+	zones, err := s.source.GetZones()
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool, len(zones))
+
+	for _, zone := range zones {
+		current[strings.ToLower(zone.Name)] = true
+		s.update(zone)
+	}
+
+	s.lock.Lock()
+	for name := range s.zones {
+		if !current[name] {
+			log.Info("Dropping zone %s", name)
+			delete(s.zones, name)
+		}
+	}
+	s.lock.Unlock()
+
+	return nil
+}
+
+// Bring a single zone in line with the database.
+func (s *Store) ReloadZone(zoneName string) (err error) {
+	zone, err := s.source.GetZoneByName(strings.ToLower(zoneName))
+	if err == sql.ErrNoRows {
+		log.Info("Dropping zone %s", zoneName)
+		s.Remove(zoneName)
+		return nil
+	} else if err != nil {
+		log.Error("Error reloading zone %s: %s", zoneName, err)
+		return err
+	}
+
+	s.update(zone)
+	return nil
+}
+
+// Load a zone when it is new or its serial changed.
+func (s *Store) update(zone db.Zone) {
+	name := strings.ToLower(zone.Name)
+
+	s.lock.RLock()
+	data, ok := s.zones[name]
+	s.lock.RUnlock()
+
+	if ok && data.zone.Id == zone.Id && data.zone.Serial == zone.Serial {
+		return
+	}
+
+	data, err := s.loadZone(zone)
+	if err != nil {
+		// Keep serving what we have, the next reload tries again
+		log.Error("Error loading zone %s: %s", zone.Name, err)
+		return
+	}
+
+	s.lock.Lock()
+	s.zones[name] = data
+	s.lock.Unlock()
+
+	log.Info("Loaded zone %s with serial %d", zone.Name, zone.Serial)
+	stats.AddToMeter("memory.loaded", 1)
+	s.loaded(zone)
+}
+
+// Reload zones every interval.
+func (s *Store) Watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := s.Reload(); err != nil {
+			log.Warn("Error reloading zones: %s", err)
+		}
+	}
+}
+
+// Serve a zone with the given RRSets, replacing any zone of the same name.
+func (s *Store) Put(zone db.Zone, rrSets []db.RecordSet) {
+	data := newZoneData(zone)
+	for _, rrSet := range rrSets {
+		data.add(rrSet)
+	}
+
+	s.lock.Lock()
+	s.zones[strings.ToLower(zone.Name)] = data
+	s.lock.Unlock()
+
+	s.loaded(zone)
+}
+
+// Have fn called each time a zone is loaded, once it is served.
+func (s *Store) OnLoad(fn func(zone db.Zone)) {
+	s.onLoad = append(s.onLoad, fn)
+}
+
+func (s *Store) loaded(zone db.Zone) {
+	for _, fn := range s.onLoad {
+		fn(zone)
+	}
+}
+
+// Stop serving a zone.
+func (s *Store) Remove(zoneName string) {
+	s.lock.Lock()
+	delete(s.zones, strings.ToLower(zoneName))
+	s.lock.Unlock()
+}
+
+// Read a zone from the source.
+func (s *Store) loadZone(zone db.Zone) (data *zoneData, err error) {
+	data = newZoneData(zone)
+
+	err = s.source.IterateZoneRecordSets(zone, "", func(rrSet db.RecordSet) error {
+		data.add(rrSet)
+		return nil
+	})
+
+	return data, err
+}
+
+func newZoneData(zone db.Zone) *zoneData {
+	return &zoneData{
+		zone:   zone,
+		rrSets: make(map[string]db.RecordSet),
+		names:  make(map[string]bool),
+	}
+}
+
+func (data *zoneData) add(rrSet db.RecordSet) {
+	data.rrSets[rrSetKey(rrSet.Name, rrSet.Type)] = rrSet
+
+	// The name and every name between it and the apex exist
+	apex := strings.ToLower(data.zone.Name)
+	name := strings.ToLower(rrSet.Name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if data.names[name[off:]] {
+			break
+		}
+		data.names[name[off:]] = true
+		if name[off:] == apex {
+			break
+		}
+	}
+}
+
+func rrSetKey(rrName string, rrType string) string {
+	return strings.ToLower(rrName) + "/" + strings.ToUpper(rrType)
+}
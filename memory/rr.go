@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package memory
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ekarlso/gomdns/db"
+	"github.com/miekg/dns"
+)
+
+// A zone described by its SOA.
+func NewZone(id string, soa *dns.SOA) db.Zone {
+	return db.Zone{
+		Id:      id,
+		Version: 1,
+		Name:    strings.ToLower(soa.Hdr.Name),
+		Email:   soa.Mbox,
+		Ttl:     soa.Hdr.Ttl,
+		Serial:  int(soa.Serial),
+		Refresh: int(soa.Refresh),
+		Retry:   int(soa.Retry),
+		Expire:  int(soa.Expire),
+		Minimum: int(soa.Minttl),
+	}
+}
+
+// Group RRs of a zone into RRSets of records the way Designate stores them.
+func RecordSets(zone db.Zone, rrs []dns.RR) (rrSets []db.RecordSet) {
+	sets := make(map[string]int)
+
+	for _, rr := range rrs {
+		header := rr.Header()
+		name := strings.ToLower(header.Name)
+		rrType := dns.Type(header.Rrtype).String()
+		key := name + "/" + rrType
+
+		i, ok := sets[key]
+		if !ok {
+			i = len(rrSets)
+			sets[key] = i
+			rrSets = append(rrSets, db.RecordSet{
+				Id:       key,
+				DomainId: zone.Id,
+				Name:     name,
+				Type:     rrType,
+				Ttl:      sql.NullInt64{Int64: int64(header.Ttl), Valid: true},
+			})
+		}
+
+		record := newRecord(rr)
+		record.Id = key + "/" + strconv.Itoa(len(rrSets[i].Records))
+		record.DomainId = zone.Id
+		record.RecordSetId = key
+		rrSets[i].Records = append(rrSets[i].Records, record)
+	}
+
+	return rrSets
+}
+
+// Turn a RR into a record, the priority of MX and SRV records apart from
+// the rest of their data.
+func newRecord(rr dns.RR) (record *db.Record) {
+	switch rr := rr.(type) {
+	case *dns.MX:
+		return &db.Record{
+			Data:     rr.Mx,
+			Priority: sql.NullInt64{Int64: int64(rr.Preference), Valid: true},
+		}
+	case *dns.SRV:
+		return &db.Record{
+			Data:     fmt.Sprintf("%d %d %s", rr.Weight, rr.Port, rr.Target),
+			Priority: sql.NullInt64{Int64: int64(rr.Priority), Valid: true},
+		}
+	}
+
+	return &db.Record{Data: strings.TrimPrefix(rr.String(), rr.Header().String())}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ekarlso/gomdns/config"
+	"github.com/miekg/dns"
+)
+
+// An xfrACL decides who may transfer a zone.
+type xfrACL struct {
+	networks []*net.IPNet
+	key      string
+}
+
+// Zone transfer ACLs, the global one and those of specific zones.
+type transferPolicy struct {
+	global xfrACL
+	zones  map[string]xfrACL
+}
+
+var transfers = &transferPolicy{zones: make(map[string]xfrACL)}
+
+// Set up the zone transfer ACLs from the configuration.
+func loadTransferPolicy(cfg *config.Configuration) (err error) {
+	policy := &transferPolicy{zones: make(map[string]xfrACL)}
+
+	policy.global, err = newXfrACL(cfg.TransferAllow, cfg.TransferKey)
+	if err != nil {
+		return err
+	}
+
+	for _, zone := range cfg.TransferZones {
+		acl, err := newXfrACL(zone.Allow, zone.Key)
+		if err != nil {
+			return fmt.Errorf("transfer ACL for %s: %s", zone.Name, err)
+		}
+		policy.zones[dns.Fqdn(strings.ToLower(zone.Name))] = acl
+	}
+
+	transfers = policy
+	return nil
+}
+
+// Create an ACL from a list of networks in CIDR notation or plain addresses
+// and the name of the TSIG key required, if any.
+func newXfrACL(allow []string, key string) (acl xfrACL, err error) {
+	for _, s := range allow {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return acl, err
+		}
+		acl.networks = append(acl.networks, network)
+	}
+
+	if key != "" {
+		acl.key = dns.Fqdn(strings.ToLower(key))
+	}
+	return acl, nil
+}
+
+// Check whether the client of writer may transfer a zone.
+func (p *transferPolicy) Allowed(zoneName string, writer dns.ResponseWriter, request *dns.Msg) bool {
+	acl, ok := p.zones[dns.Fqdn(strings.ToLower(zoneName))]
+	if !ok {
+		acl = p.global
+	}
+
+	return acl.allows(writer, request)
+}
+
+func (acl xfrACL) allows(writer dns.ResponseWriter, request *dns.Msg) bool {
+	if len(acl.networks) > 0 {
+		ip := remoteIP(writer.RemoteAddr())
+		if ip == nil {
+			return false
+		}
+
+		found := false
+		for _, network := range acl.networks {
+			if network.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if acl.key != "" {
+		tsig := request.IsTsig()
+		if tsig == nil || strings.ToLower(tsig.Hdr.Name) != acl.key || writer.TsigStatus() != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get the IP address of a client.
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
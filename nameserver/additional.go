@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"database/sql"
+	"strings"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+)
+
+// Add the A and AAAA records we serve for the targets of MX, SRV and NS
+// records in the answer and authority sections to the additional section.
+func resolveAdditional(m *dns.Msg) {
+	seen := make(map[string]bool)
+
+	// Glue from a referral is already there
+	for _, rr := range m.Extra {
+		seen[strings.ToLower(rr.Header().Name)] = true
+	}
+
+	sections := append(append([]dns.RR{}, m.Answer...), m.Ns...)
+	for _, rr := range sections {
+		var target string
+
+		switch record := rr.(type) {
+		case *dns.MX:
+			target = record.Mx
+		case *dns.SRV:
+			target = record.Target
+		case *dns.NS:
+			target = record.Ns
+		default:
+			continue
+		}
+
+		target = strings.ToLower(target)
+		if target == "." || seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		records, err := resolveAddresses(target)
+		if err != nil {
+			log.Warn("Error getting additional records for %s: %s", target, err)
+			continue
+		}
+		m.Extra = append(m.Extra, records...)
+	}
+}
+
+// Get the A and AAAA records for a name if it is in one of our zones.
+func resolveAddresses(name string) (records []dns.RR, err error) {
+	zone, err := findZone(name)
+	if err == sql.ErrNoRows {
+		return records, nil
+	} else if err != nil {
+		return records, err
+	}
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		q := dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+
+		addresses, err := ResolveRRSetQuery(zone, q)
+		if err != nil && err != sql.ErrNoRows {
+			return records, err
+		}
+		records = append(records, addresses...)
+	}
+
+	return records, nil
+}
+
+// Trim a response to fit in size bytes. Additional RRSets past the first
+// glue records are optional and are dropped first, except for the EDNS0 OPT
+// record; if the rest still does not fit the response is truncated and TC
+// set so the client retries over TCP. Glue is required as per RFC 9471.
+func fitResponse(m *dns.Msg, size int, glue int) {
+	extra, opt := splitEdns0(m.Extra)
+	fits := func() bool {
+		m.Extra = extra
+		if opt != nil {
+			m.Extra = append(extra[:len(extra):len(extra)], opt)
+		}
+		return m.Len() <= size
+	}
+
+	for !fits() && len(extra) > glue {
+		extra = dropLastRRSet(extra)
+	}
+	if fits() {
+		return
+	}
+
+	m.Truncated = true
+	stats.AddToMeter("response.truncated", 1)
+
+	for !fits() && len(extra) > 0 {
+		extra = dropLastRRSet(extra)
+	}
+
+	for m.Len() > size && len(m.Ns) > 0 {
+		m.Ns = dropLastRRSet(m.Ns)
+	}
+	for m.Len() > size && len(m.Answer) > 0 {
+		m.Answer = dropLastRRSet(m.Answer)
+	}
+}
+
+// Remove the trailing RRSet from a section, as RRSets are never split.
+func dropLastRRSet(section []dns.RR) []dns.RR {
+	last := section[len(section)-1].Header()
+
+	i := len(section) - 1
+	for i > 0 {
+		h := section[i-1].Header()
+		if h.Rrtype != last.Rrtype || !strings.EqualFold(h.Name, last.Name) {
+			break
+		}
+		i--
+	}
+
+	return section[:i]
+}
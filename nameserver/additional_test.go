@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// A referral to sub.example.org. with in-domain glue for each of its
+// nameservers, too large for a plain UDP response.
+func bigReferral(t *testing.T) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("www.sub.example.org.", dns.TypeA)
+	m.Response = true
+	m.Compress = true
+
+	for i := 0; i < 13; i++ {
+		ns := fmt.Sprintf("ns%d.sub.example.org.", i)
+		for _, s := range []string{
+			"sub.example.org. 3600 IN NS " + ns,
+			ns + " 3600 IN A 192.0.2.1",
+			ns + " 3600 IN AAAA 2001:db8::1",
+		} {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rr.Header().Rrtype == dns.TypeNS {
+				m.Ns = append(m.Ns, rr)
+			} else {
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+	}
+	return m
+}
+
+func TestFitResponseGlue(t *testing.T) {
+	stats.NameServerStats = metrics.NewRegistry()
+
+	m := bigReferral(t)
+	fitResponse(m, dns.MinMsgSize, len(m.Extra))
+
+	if !m.Truncated {
+		t.Errorf("expected TC when glue does not fit")
+	}
+	if m.Len() > dns.MinMsgSize {
+		t.Errorf("expected at most %d bytes, got %d", dns.MinMsgSize, m.Len())
+	}
+}
+
+func TestFitResponseOptional(t *testing.T) {
+	stats.NameServerStats = metrics.NewRegistry()
+
+	m := bigReferral(t)
+	fitResponse(m, dns.MinMsgSize, 0)
+
+	if m.Truncated {
+		t.Errorf("expected no TC when only optional records are dropped")
+	}
+	if len(m.Ns) != 13 {
+		t.Errorf("expected the NS RRSet to be kept, got %d records", len(m.Ns))
+	}
+	if m.Len() > dns.MinMsgSize {
+		t.Errorf("expected at most %d bytes, got %d", dns.MinMsgSize, m.Len())
+	}
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"github.com/ekarlso/gomdns/db"
+)
+
+var (
+	// Where queries are answered from
+	backend db.Backend
+	// Where transfers are served from, skipping any cache in front of
+	// backend so secondaries are never handed stale data
+	xfrBackend db.Backend
+)
+
+// Answer queries from b and serve transfers from xfr, this has to be done
+// before serving.
+func SetBackend(b db.Backend, xfr db.Backend) {
+	backend = b
+	xfrBackend = xfr
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/ekarlso/gomdns/db"
+	"github.com/miekg/dns"
+)
+
+// A db.Backend serving zones from memory, for testing without a database.
+type fakeBackend struct {
+	zones  map[string]db.Zone
+	rrSets map[string][]db.RecordSet
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{zones: map[string]db.Zone{}, rrSets: map[string][]db.RecordSet{}}
+}
+
+// Add a zone with an RRSet holding data for every record.
+func (b *fakeBackend) add(zone db.Zone, name string, rrType string, data ...string) {
+	b.zones[zone.Name] = zone
+
+	rrSet := db.RecordSet{Id: name + rrType, DomainId: zone.Id, Name: name, Type: rrType}
+	for _, d := range data {
+		rrSet.Records = append(rrSet.Records, &db.Record{DomainId: zone.Id, RecordSetId: rrSet.Id, Data: d})
+	}
+	b.rrSets[zone.Id] = append(b.rrSets[zone.Id], rrSet)
+}
+
+func (b *fakeBackend) GetZoneByName(zoneName string) (db.Zone, error) {
+	zone, ok := b.zones[zoneName]
+	if !ok {
+		return zone, sql.ErrNoRows
+	}
+	return zone, nil
+}
+
+func (b *fakeBackend) GetZones() (zones []db.Zone, err error) {
+	for _, zone := range b.zones {
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+func (b *fakeBackend) GetRecordSet(zone db.Zone, rrName string, rrType string) (db.RecordSet, error) {
+	for _, rrSet := range b.rrSets[zone.Id] {
+		if rrSet.Name == rrName && rrSet.Type == rrType {
+			return rrSet, nil
+		}
+	}
+	return db.RecordSet{}, sql.ErrNoRows
+}
+
+func (b *fakeBackend) NameExists(zone db.Zone, rrName string) (bool, error) {
+	for _, rrSet := range b.rrSets[zone.Id] {
+		if rrSet.Name == rrName || strings.HasSuffix(rrSet.Name, "."+rrName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *fakeBackend) IterateZoneRecordSets(zone db.Zone, notType string, fn func(db.RecordSet) error) error {
+	for _, rrSet := range b.rrSets[zone.Id] {
+		if rrSet.Type == notType {
+			continue
+		}
+		if err := fn(rrSet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestResolveZone(t *testing.T) {
+	zone := db.Zone{Id: "1", Name: "example.org.", Ttl: 3600, Serial: 2}
+	b := newFakeBackend()
+	b.add(zone, "example.org.", "SOA", "ns1.example.org. admin.example.org. 2 3600 600 86400 300")
+	b.add(zone, "example.org.", "NS", "ns1.example.org.")
+	b.add(zone, "www.example.org.", "A", "192.0.2.1", "192.0.2.2")
+
+	soa, records, err := resolveZone(b, zone)
+	if err != nil {
+		t.Fatalf("resolveZone: %s", err)
+	}
+	if soa.Serial != 2 {
+		t.Errorf("expected serial 2, got %d", soa.Serial)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records besides the SOA, got %d", len(records))
+	}
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			t.Errorf("SOA returned among the records: %s", rr)
+		}
+	}
+}
+
+func TestResolveZoneWithoutSOA(t *testing.T) {
+	zone := db.Zone{Id: "1", Name: "example.org.", Ttl: 3600}
+	b := newFakeBackend()
+	b.add(zone, "www.example.org.", "A", "192.0.2.1")
+
+	if _, _, err := resolveZone(b, zone); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
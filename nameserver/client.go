@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Compare serials using RFC 1982 serial number arithmetic.
+func SerialGreater(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// Add the default port to servers given without one.
+func WithPorts(servers []string) (addrs []string) {
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs = append(addrs, server)
+	}
+	return addrs
+}
+
+// Sign m with a TSIG key, if one is given, returning the secrets to verify
+// the answer with.
+func SignMsg(m *dns.Msg, keyName string) (secrets map[string]string, err error) {
+	if keyName == "" {
+		return nil, nil
+	}
+
+	algorithm, secret, ok := TsigKey(keyName)
+	if !ok {
+		return nil, fmt.Errorf("unknown TSIG key %s", keyName)
+	}
+
+	key := dns.Fqdn(strings.ToLower(keyName))
+	m.SetTsig(key, algorithm, 300, time.Now().Unix())
+	return map[string]string{key: secret}, nil
+}
+
+// Ask a server for the serial it has for a zone, signing the query with
+// keyName if given. A timeout of 0 leaves the client default.
+func QuerySerial(zoneName string, server string, keyName string, timeout time.Duration) (serial uint32, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zoneName, dns.TypeSOA)
+
+	c := new(dns.Client)
+	c.ReadTimeout = timeout
+	if c.TsigSecret, err = SignMsg(m, keyName); err != nil {
+		return 0, err
+	}
+
+	r, _, err := c.Exchange(m, server)
+	if err != nil {
+		return 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("%s answered %s", server, dns.RcodeToString[r.Rcode])
+	}
+
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no SOA in answer")
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"net"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+)
+
+// Check the EDNS0 version of a request, answering BADVERS for anything but
+// version 0 as per RFC 6891 section 6.1.3.
+func checkEdns0(request *dns.Msg, m *dns.Msg) bool {
+	opt := request.IsEdns0()
+	if opt == nil || opt.Version() == 0 {
+		return true
+	}
+
+	log.Debug("Unsupported EDNS version %d", opt.Version())
+	stats.AddToMeter("response.badvers", 1)
+
+	m.Authoritative = false
+	m.Rcode = dns.RcodeBadVers
+	return false
+}
+
+// Add our OPT record to the response of an EDNS0 request, advertising the
+// largest UDP payload we are willing to send.
+func setEdns0(request *dns.Msg, m *dns.Msg) {
+	if request.IsEdns0() == nil {
+		return
+	}
+
+	cfg := config.GetConfig()
+	m.SetEdns0(cfg.MaxUdpSize(), false)
+}
+
+// Get the largest response we may send for a request to the client of
+// writer. That is the UDP size the client advertises, bounded by our own
+// maximum, or 512 bytes for clients without EDNS0.
+func responseSize(writer dns.ResponseWriter, request *dns.Msg) int {
+	if _, ok := writer.RemoteAddr().(*net.UDPAddr); !ok {
+		return dns.MaxMsgSize
+	}
+
+	size := dns.MinMsgSize
+
+	if opt := request.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+
+		cfg := config.GetConfig()
+		if max := int(cfg.MaxUdpSize()); size > max {
+			size = max
+		}
+	}
+
+	return size
+}
+
+// Split the OPT record from the additional section.
+func splitEdns0(section []dns.RR) (records []dns.RR, opt *dns.OPT) {
+	for _, rr := range section {
+		if o, ok := rr.(*dns.OPT); ok {
+			opt = o
+			continue
+		}
+		records = append(records, rr)
+	}
+
+	return records, opt
+}
@@ -20,7 +20,9 @@
 package nameserver
 
 import (
-	"net"
+	"database/sql"
+	"errors"
+	"fmt"
 	"sort"
 	"strings"
 
@@ -31,9 +33,19 @@ import (
 	"github.com/miekg/dns"
 )
 
+// Longest CNAME chain followed within our own zones.
+const maxCNAMEChain = 8
+
 func Handler(writer dns.ResponseWriter, request *dns.Msg) {
 	var err error
 
+	if len(request.Question) != 1 {
+		m := new(dns.Msg)
+		m.SetRcode(request, dns.RcodeFormatError)
+		writer.WriteMsg(m)
+		return
+	}
+
 	query := request.Question[0]
 
 	log.Info("Received query for %s type %s from %s", query.Name, query.Qtype, writer.RemoteAddr())
@@ -41,11 +53,33 @@ func Handler(writer dns.ResponseWriter, request *dns.Msg) {
 	stats.AddToMeter("query.total", 1)
 	stats.AddToMeter("query."+strings.ToLower(dns.TypeToString[query.Qtype]), 1)
 
-	if query.Qtype == dns.TypeAXFR || query.Qtype == dns.TypeIXFR {
-		ResolveXFR(query, writer, request)
+	if !checkTsig(writer, request) {
+		return
+	}
+
+	switch request.Opcode {
+	case dns.OpcodeQuery:
+	case dns.OpcodeNotify:
+		if err = ResolveNotify(writer, request); err != nil {
+			log.Error("Something went bad: %s", err)
+		}
 		return
+	default:
+		m := new(dns.Msg)
+		m.SetRcode(request, dns.RcodeNotImplemented)
+		signResponse(request, m)
+		writer.WriteMsg(m)
+		return
+	}
+
+	switch query.Qtype {
+	case dns.TypeAXFR:
+		err = ResolveXFR(query, writer, request)
+	case dns.TypeIXFR:
+		err = ResolveIXFR(query, writer, request)
+	default:
+		err = ResolveQuery(writer, request)
 	}
-	err = ResolveQuery(writer, request)
 
 	if err != nil {
 		log.Error("Something went bad: %s", err)
@@ -72,8 +106,15 @@ func ResolveQuery(writer dns.ResponseWriter, request *dns.Msg) (err error) {
 		log.Debug("Query: %v\n", m.String())
 	}
 
+	// Number of leading additional records that are required glue
+	glue := 0
+
 	// Deferred write
 	defer func() {
+		setEdns0(request, m)
+		fitResponse(m, responseSize(writer, request)-tsigSize(request), glue)
+		signResponse(request, m)
+
 		err := writer.WriteMsg(m)
 
 		if err != nil {
@@ -82,74 +123,256 @@ func ResolveQuery(writer dns.ResponseWriter, request *dns.Msg) (err error) {
 		}
 	}()
 
-	records, err := ResolveRRSetQuery(query)
+	if !checkEdns0(request, m) {
+		return nil
+	}
+
+	zone, err := findZone(query.Name)
+	if err == sql.ErrNoRows {
+		// Not a name within any of our zones
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		stats.AddToMeter("response.refused", 1)
+		return nil
+	} else if err != nil {
+		m.Rcode = dns.RcodeServerFailure
+		stats.AddToMeter("response.servfail", 1)
+		return err
+	}
 
-	m.Answer = records
-	return err
+	err = resolveAnswer(m, zone, query)
+	if err != nil {
+		m.Answer, m.Ns, m.Extra = nil, nil, nil
+		m.Rcode = dns.RcodeServerFailure
+		stats.AddToMeter("response.servfail", 1)
+		return err
+	}
+
+	// Only the glue of a referral is in the additional section so far
+	glue = len(m.Extra)
+
+	resolveAdditional(m)
+	return nil
 }
 
-func ResolveXFR(query dns.Question, writer dns.ResponseWriter, request *dns.Msg) (err error) {
-	// Handle an A|I XFR
+// Fill in the answer for a query in a zone, chasing CNAMEs through the zones
+// we serve until data is found, the chain leaves our zones or it exceeds
+// maxCNAMEChain links. Names that do not exist are answered from a wildcard
+// at their closest encloser when there is one, and names at or below a zone
+// cut get a referral.
+func resolveAnswer(m *dns.Msg, zone db.Zone, query dns.Question) (err error) {
+	seen := make(map[string]bool)
 
-	channel := make(chan *dns.Envelope)
-	transfer := new(dns.Transfer)
-	defer close(channel)
+	for {
+		delegation, err := findDelegation(zone, query)
+		if err != nil {
+			return err
+		}
+		if len(delegation) > 0 {
+			return resolveReferral(m, zone, delegation)
+		}
 
-	err = transfer.Out(writer, request, channel)
-	if err != nil {
-		return
+		records, cname, err := resolveName(zone, query, query.Name)
+		if err != nil {
+			return err
+		}
+
+		if len(records) == 0 && cname == nil {
+			exists, err := backend.NameExists(zone, strings.ToLower(query.Name))
+			if err != nil {
+				return err
+			}
+			if exists {
+				return resolveNegative(m, zone, false)
+			}
+
+			wildcard, err := findWildcard(zone, query.Name)
+			if err != nil {
+				return err
+			}
+			if wildcard == "" {
+				return resolveNegative(m, zone, true)
+			}
+
+			records, cname, err = resolveName(zone, query, wildcard)
+			if err != nil {
+				return err
+			}
+			if len(records) == 0 && cname == nil {
+				return resolveNegative(m, zone, false)
+			}
+
+			stats.AddToMeter("response.wildcard", 1)
+		}
+
+		if len(records) > 0 {
+			m.Answer = append(m.Answer, records...)
+			m.Ns = resolveAuthority(zone, query)
+			return nil
+		}
+
+		m.Answer = append(m.Answer, cname)
+		seen[strings.ToLower(query.Name)] = true
+
+		target := strings.ToLower(cname.Target)
+		if seen[target] {
+			log.Warn("CNAME loop at %s for %s", target, m.Question[0].Name)
+			return nil
+		}
+		if len(seen) >= maxCNAMEChain {
+			log.Warn("CNAME chain for %s longer than %d", m.Question[0].Name, maxCNAMEChain)
+			return nil
+		}
+
+		zone, err = findZone(target)
+		if err == sql.ErrNoRows {
+			// Target is not ours, leave it to the resolver
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		query = dns.Question{Name: target, Qtype: query.Qtype, Qclass: query.Qclass}
 	}
+}
 
-	var (
-		records []dns.RR
-		rrSets  []db.RecordSet
-		zone    db.Zone
-	)
+// Get the RRSet matching the query type owned by source, or failing that the
+// CNAME owned by it. When source is a wildcard the owner names are
+// synthesised from the query name.
+func resolveName(zone db.Zone, query dns.Question, source string) (records []dns.RR, cname *dns.CNAME, err error) {
+	q := dns.Question{Name: source, Qtype: query.Qtype, Qclass: query.Qclass}
 
-	zone, err = db.GetZoneByName(strings.ToLower(query.Name))
+	records, err = ResolveRRSetQuery(zone, q)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
 
-	q := dns.Question{Qtype: dns.TypeSOA, Name: query.Name}
-	soa, err := ResolveRRSetQuery(q)
+	if len(records) == 0 && query.Qtype != dns.TypeCNAME {
+		q.Qtype = dns.TypeCNAME
 
-	if err != nil {
-		log.Error("Error getting SOA for XFR")
-		return nil
+		cnames, err := ResolveRRSetQuery(zone, q)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+
+		if len(cnames) > 0 {
+			cname, _ = cnames[0].(*dns.CNAME)
+			records = nil
+		}
+	}
+
+	if source != query.Name {
+		for _, rr := range records {
+			rr.Header().Name = query.Name
+		}
+		if cname != nil {
+			cname.Hdr.Name = query.Name
+		}
 	}
 
-	rrSets, err = db.GetZoneRecordSets(zone, "", "SOA")
+	return records, cname, nil
+}
+
+// Fill in a referral to the nameservers of a delegated child zone, with the
+// glue we have for them in the additional section.
+func resolveReferral(m *dns.Msg, zone db.Zone, delegation []dns.RR) (err error) {
+	// Only an answer gathered before reaching the cut is authoritative
+	m.Authoritative = len(m.Answer) > 0
+	m.Ns = append(m.Ns, delegation...)
+
+	glue, err := resolveGlue(zone, delegation)
 	if err != nil {
-		log.Debug("Error getting rrSets and records")
 		return err
 	}
+	m.Extra = append(m.Extra, glue...)
 
-	records = append(records, soa[0])
-
-	for i, _ := range rrSets {
-		rrSetRR, err := resolveRRSet(query, rrSets[i])
+	stats.AddToMeter("response.referral", 1)
+	return nil
+}
 
-		if err != nil {
-			log.Error("Error getting RRs for %v, error %v.", query.Name, err)
-			return err
+// Get the A and AAAA records for the targets of a NS RRSet that are at or
+// below the zone cut, the in-domain glue without which the delegation cannot
+// be followed. Addresses of other targets are left to resolveAdditional.
+func resolveGlue(zone db.Zone, delegation []dns.RR) (records []dns.RR, err error) {
+	for _, rr := range delegation {
+		ns, ok := rr.(*dns.NS)
+		if !ok || !dns.IsSubDomain(strings.ToLower(ns.Hdr.Name), strings.ToLower(ns.Ns)) {
+			continue
 		}
 
-		for j, _ := range rrSetRR {
-			records = append(records, rrSetRR[j])
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			q := dns.Question{Name: ns.Ns, Qtype: qtype, Qclass: dns.ClassINET}
+
+			glue, err := ResolveRRSetQuery(zone, q)
+			if err != nil && err != sql.ErrNoRows {
+				return records, err
+			}
+			records = append(records, glue...)
 		}
 	}
 
-	records = append(records, soa[0])
+	return records, nil
+}
 
-	log.Debug("Records %v", len(records))
+// Fill in a RFC 2308 negative response, NXDOMAIN if the name does not exist
+// in the zone and NODATA if it exists but not with the queried type.
+func resolveNegative(m *dns.Msg, zone db.Zone, nxdomain bool) (err error) {
+	if nxdomain {
+		m.Rcode = dns.RcodeNameError
+		stats.AddToMeter("response.nxdomain", 1)
+	} else {
+		stats.AddToMeter("response.nodata", 1)
+	}
+
+	soa, err := resolveNegativeSOA(zone)
+	if err != nil {
+		log.Error("Error getting SOA for %s: %s", zone.Name, err)
+		return err
+	}
+
+	m.Ns = append(m.Ns, soa)
+	return nil
+}
+
+// Get the SOA of a zone for the authority section of a negative response,
+// with the TTL capped to the SOA minimum as per RFC 2308 section 5.
+func resolveNegativeSOA(zone db.Zone) (record dns.RR, err error) {
+	q := dns.Question{Qtype: dns.TypeSOA, Name: zone.Name}
+
+	soa, err := ResolveRRSetQuery(zone, q)
+	if err != nil {
+		return record, err
+	}
+	if len(soa) == 0 {
+		return record, errors.New("zone " + zone.Name + " has no SOA")
+	}
+
+	record = soa[0]
+	if minttl := record.(*dns.SOA).Minttl; minttl < record.Header().Ttl {
+		record.Header().Ttl = minttl
+	}
+
+	return record, nil
+}
+
+// Get the NS RRSet at the zone apex for the authority section of a positive
+// answer, unless the answer already is that RRSet.
+func resolveAuthority(zone db.Zone, query dns.Question) (records []dns.RR) {
+	if query.Qtype == dns.TypeNS && strings.ToLower(query.Name) == zone.Name {
+		return records
+	}
 
-	envelope := &dns.Envelope{RR: records}
-	channel <- envelope
-	writer.Hijack()
+	q := dns.Question{Qtype: dns.TypeNS, Name: zone.Name}
 
-	return err
+	records, err := ResolveRRSetQuery(zone, q)
+	if err != nil {
+		log.Warn("Error getting NS for %s: %s", zone.Name, err)
+	}
+	return records
 }
 
-// Handle a RRSet
-func ResolveRRSetQuery(query dns.Question) (records []dns.RR, err error) {
+// Handle a RRSet within a zone
+func ResolveRRSetQuery(zone db.Zone, query dns.Question) (records []dns.RR, err error) {
 	log.Info("Attempting to resolve RRSet")
 
 	// Attempt to resolve a RRSet and it's Records
@@ -162,51 +385,37 @@ func ResolveRRSetQuery(query dns.Question) (records []dns.RR, err error) {
 	rrType = dns.TypeToString[query.Qtype]
 	queryName = strings.ToLower(query.Name)
 
-	rrSet, err = db.GetRecordSet(queryName, rrType)
+	rrSet, err = backend.GetRecordSet(zone, queryName, rrType)
 	if err != nil {
-		log.Error("RecordSet not found", err)
+		log.Debug("RecordSet not found: %s", err)
 		return records, err
 	}
 
-	records, err = resolveRRSet(query, rrSet)
+	records, err = resolveRRSet(zone, rrSet)
 	return records, err
 }
 
-// Extract Ttl either from a RRset or a Zone
-func resolveRRSetTtl(rrSet db.RecordSet) (ttl uint32, err error) {
-	var zone db.Zone
-
+// Extract Ttl either from a RRset or the Zone it belongs to
+func resolveRRSetTtl(zone db.Zone, rrSet db.RecordSet) (ttl uint32) {
 	if rrSet.Ttl.Valid {
-		ttl = uint32(rrSet.Ttl.Int64)
-	} else {
-		log.Debug("Using TTL from domain %s", rrSet.DomainId)
-
-		zone, err = db.GetZoneById(rrSet.DomainId)
-		if err != nil {
-			return ttl, err
-		}
-
-		ttl = zone.Ttl
+		return uint32(rrSet.Ttl.Int64)
 	}
-	return ttl, err
+
+	log.Debug("Using TTL from domain %s", zone.Name)
+	return zone.Ttl
 }
 
 // Create a header
-func resolveRRSetHeader(rrSet db.RecordSet) (header dns.RR_Header, err error) {
-	var ttl uint32
-
-	ttl, err = resolveRRSetTtl(rrSet)
-	if err != nil {
-		return header, err
-	}
+func resolveRRSetHeader(zone db.Zone, rrSet db.RecordSet) (header dns.RR_Header, err error) {
+	ttl := resolveRRSetTtl(zone, rrSet)
 	rrType := dns.StringToType[rrSet.Type]
 
 	header = dns.RR_Header{Name: rrSet.Name, Rrtype: rrType, Class: dns.ClassINET, Ttl: ttl}
 	return header, err
 }
 
-// Create dns.RR records from a query and rrSet
-func resolveRRSet(query dns.Question, rrSet db.RecordSet) (records []dns.RR, err error) {
+// Create dns.RR records from a rrSet in a zone
+func resolveRRSet(zone db.Zone, rrSet db.RecordSet) (records []dns.RR, err error) {
 	if len(rrSet.Records) == 0 {
 		log.Debug("No records on RRSet %v", rrSet.Id)
 		return records, err
@@ -214,69 +423,160 @@ func resolveRRSet(query dns.Question, rrSet db.RecordSet) (records []dns.RR, err
 
 	rrType := dns.StringToType[rrSet.Type]
 
-	// Sort MX / SRV by priority
+	// Sort MX / SRV by priority, on a copy as backends may hand out the
+	// records they hold
 	if rrType == dns.TypeMX || rrType == dns.TypeSRV {
+		rrSet.Records = append(db.Records{}, rrSet.Records...)
 		sort.Sort(db.ByPriority{rrSet.Records})
 	}
 
-	header, err := resolveRRSetHeader(rrSet)
+	header, err := resolveRRSetHeader(zone, rrSet)
 
 	for _, r := range rrSet.Records {
-		var record dns.RR
-
-		switch rrType {
-		case dns.TypeA:
-			record = &dns.A{Hdr: header, A: net.ParseIP(r.Data)}
-		case dns.TypeAAAA:
-			record = &dns.AAAA{Hdr: header, AAAA: net.ParseIP(r.Data)}
-		case dns.TypeCNAME:
-			record = &dns.CNAME{Hdr: header, Target: r.Data}
-		case dns.TypeMX:
-			record = &dns.MX{
-				Hdr:        header,
-				Preference: uint16(r.Priority.Int64),
-				Mx:         r.Data}
-		case dns.TypeNS:
-			record = &dns.NS{Hdr: header, Ns: r.Data}
-		case dns.TypeSOA:
-			soa := r.ExtractSOA()
-			record = &dns.SOA{
-				Hdr:     header,
-				Ns:      soa.Ns,
-				Mbox:    soa.Mbox,
-				Serial:  soa.Serial,
-				Refresh: soa.Refresh,
-				Retry:   soa.Retry,
-				Expire:  soa.Expire,
-				Minttl:  soa.Minttl,
-			}
+		record, err := resolveRecord(header, r)
+		if err != nil {
+			log.Error("Error resolving %s %s: %s", rrSet.Name, rrSet.Type, err)
+			return nil, err
+		}
 
-		case dns.TypeSRV:
-			srv := r.ExtractSrv()
+		records = append(records, record)
+	}
 
-			record = &dns.SRV{
-				Hdr:      header,
-				Priority: uint16(r.Priority.Int64),
-				Weight:   srv.Weight,
-				Port:     srv.Port,
-				Target:   srv.Target,
-			}
-		case dns.TypeTXT:
-			var txt []string
-			txt = append(txt, r.Data)
+	return records, err
+}
 
-			record = &dns.TXT{
-				Hdr: header,
-				Txt: txt,
-			}
+// Create a dns.RR from a record, validating its data on the way.
+func resolveRecord(header dns.RR_Header, r *db.Record) (record dns.RR, err error) {
+	switch header.Rrtype {
+	case dns.TypeA:
+		ip, err := r.ExtractIPv4()
+		if err != nil {
+			return nil, err
+		}
+		record = &dns.A{Hdr: header, A: ip}
+	case dns.TypeAAAA:
+		ip, err := r.ExtractIPv6()
+		if err != nil {
+			return nil, err
+		}
+		record = &dns.AAAA{Hdr: header, AAAA: ip}
+	case dns.TypeCNAME:
+		target, err := r.ExtractName()
+		if err != nil {
+			return nil, err
+		}
+		record = &dns.CNAME{Hdr: header, Target: target}
+	case dns.TypeMX:
+		preference, err := r.ExtractPriority()
+		if err != nil {
+			return nil, err
+		}
+		mx, err := r.ExtractName()
+		if err != nil {
+			return nil, err
+		}
+		record = &dns.MX{
+			Hdr:        header,
+			Preference: preference,
+			Mx:         mx}
+	case dns.TypeNS:
+		ns, err := r.ExtractName()
+		if err != nil {
+			return nil, err
+		}
+		record = &dns.NS{Hdr: header, Ns: ns}
+	case dns.TypeSOA:
+		soa, err := r.ExtractSOA()
+		if err != nil {
+			return nil, err
+		}
+		record = &dns.SOA{
+			Hdr:     header,
+			Ns:      soa.Ns,
+			Mbox:    soa.Mbox,
+			Serial:  soa.Serial,
+			Refresh: soa.Refresh,
+			Retry:   soa.Retry,
+			Expire:  soa.Expire,
+			Minttl:  soa.Minttl,
+		}
+
+	case dns.TypeSRV:
+		priority, err := r.ExtractPriority()
+		if err != nil {
+			return nil, err
+		}
+		srv, err := r.ExtractSrv()
+		if err != nil {
+			return nil, err
+		}
+
+		record = &dns.SRV{
+			Hdr:      header,
+			Priority: priority,
+			Weight:   srv.Weight,
+			Port:     srv.Port,
+			Target:   srv.Target,
+		}
+	case dns.TypeTXT, dns.TypeSPF:
+		txt, err := r.ExtractTxt()
+		if err != nil {
+			return nil, err
 		}
 
-		if record != nil {
-			records = append(records, record)
+		if header.Rrtype == dns.TypeSPF {
+			record = &dns.SPF{Hdr: header, Txt: escapeTxt(txt)}
 		} else {
-			log.Error("Unhandled record")
+			record = &dns.TXT{Hdr: header, Txt: escapeTxt(txt)}
+		}
+	default:
+		// Anything else goes through the presentation format parser
+		record, err = newRR(header, r.Data)
+		if err != nil {
+			return nil, &db.RecordError{Id: r.Id, Data: r.Data, Err: err}
 		}
 	}
 
-	return records, err
+	return record, nil
+}
+
+// Escape character-strings the way miekg/dns expects them in TXT records.
+func escapeTxt(txt []string) (escaped []string) {
+	for _, str := range txt {
+		var b []byte
+
+		for i := 0; i < len(str); i++ {
+			c := str[i]
+
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c < ' ' || c > '~':
+				b = append(b, fmt.Sprintf("\\%03d", c)...)
+			default:
+				b = append(b, c)
+			}
+		}
+
+		escaped = append(escaped, string(b))
+	}
+
+	return escaped
+}
+
+// Create a dns.RR of any type miekg/dns knows from its presentation format
+// data, as Designate stores it.
+func newRR(header dns.RR_Header, data string) (record dns.RR, err error) {
+	rrType, ok := dns.TypeToString[header.Rrtype]
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %d", header.Rrtype)
+	}
+
+	s := fmt.Sprintf("%s %d IN %s %s", header.Name, header.Ttl, rrType, data)
+
+	record, err = dns.NewRR(s)
+	if err == nil && record == nil {
+		err = fmt.Errorf("empty %s record", rrType)
+	}
+	return record, err
 }
@@ -0,0 +1,313 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/jmoiron/sqlx"
+	"github.com/miekg/dns"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// A dns.ResponseWriter keeping the messages written to it.
+type testWriter struct {
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func newTestWriter(network string) *testWriter {
+	if network == "tcp" {
+		return &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.100"), Port: 53000}}
+	}
+	return &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 53000}}
+}
+
+func (w *testWriter) LocalAddr() net.Addr       { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error { w.msgs = append(w.msgs, m); return nil }
+func (w *testWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+func (w *testWriter) Close() error        { return nil }
+func (w *testWriter) TsigStatus() error   { return nil }
+func (w *testWriter) TsigTimersOnly(bool) {}
+func (w *testWriter) Hijack()             {}
+
+// The records of example.org., with a wildcard and a delegation to
+// sub.example.org. with glue.
+var testRecords = []struct {
+	name, rrType, data string
+}{
+	{"example.org.", "SOA", "ns1.example.org. admin.example.org. 1 3600 600 86400 300"},
+	{"example.org.", "NS", "ns1.example.org."},
+	{"ns1.example.org.", "A", "192.0.2.53"},
+	{"www.example.org.", "A", "192.0.2.1"},
+	{"alias.example.org.", "CNAME", "www.example.org."},
+	{"*.wild.example.org.", "A", "192.0.2.2"},
+	{"sub.example.org.", "NS", "ns.sub.example.org."},
+	{"ns.sub.example.org.", "A", "192.0.2.3"},
+}
+
+// Serve example.org. from a SQLite database in a temporary file, set up the
+// way the daemon does from a configuration file. An in-memory database
+// would not do as every connection of the pool gets its own. Returns a
+// connection to change the zone with.
+func setupSQLite(t *testing.T) *sqlx.DB {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "gomdns.toml")
+	toml := fmt.Sprintf("[storage]\ndsn = \"sqlite://%s\"\n", filepath.Join(dir, "zones.db"))
+	if err := ioutil.WriteFile(file, []byte(toml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.LoadConfiguration(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := db.Setup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver, dsn := cfg.StorageDriverDSN()
+	conn, err := sqlx.Open(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.MustExec("INSERT INTO domains (id, name, email, ttl, serial) VALUES ('1', 'example.org.', 'admin@example.org', 3600, 1)")
+	for i, r := range testRecords {
+		conn.MustExec("INSERT INTO recordsets (id, domain_id, name, type) VALUES (?, '1', ?, ?)", i, r.name, r.rrType)
+		conn.MustExec("INSERT INTO records (id, domain_id, recordset_id, data, hash) VALUES (?, '1', ?, ?, ?)", i, i, r.data, i)
+	}
+
+	stats.NameServerStats = metrics.NewRegistry()
+	transfers = &transferPolicy{zones: make(map[string]xfrACL)}
+	journal = NewJournal()
+	SetBackend(backend, backend)
+	return conn
+}
+
+// Send a query through the handler and return the response.
+func query(t *testing.T, name string, qtype uint16) *dns.Msg {
+	request := new(dns.Msg)
+	request.SetQuestion(name, qtype)
+
+	writer := newTestWriter("udp")
+	Handler(writer, request)
+
+	if len(writer.msgs) != 1 {
+		t.Fatalf("%s %s: expected one response, got %d", name, dns.TypeToString[qtype], len(writer.msgs))
+	}
+	return writer.msgs[0]
+}
+
+// Check that rrs hold exactly the records in want, in presentation format.
+func checkRecords(t *testing.T, section string, rrs []dns.RR, want ...string) {
+	if len(rrs) != len(want) {
+		t.Errorf("%s: expected %d records, got %v", section, len(want), rrs)
+		return
+	}
+	for i, rr := range rrs {
+		w, err := dns.NewRR(want[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !dns.IsDuplicate(rr, w) || rr.Header().Ttl != w.Header().Ttl {
+			t.Errorf("%s: expected %s, got %s", section, w, rr)
+		}
+	}
+}
+
+func TestQueryNoError(t *testing.T) {
+	setupSQLite(t)
+
+	m := query(t, "www.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || !m.Authoritative {
+		t.Errorf("expected an authoritative NOERROR, got %s", m)
+	}
+	checkRecords(t, "answer", m.Answer, "www.example.org. 3600 IN A 192.0.2.1")
+}
+
+func TestQueryNXDomain(t *testing.T) {
+	setupSQLite(t)
+
+	m := query(t, "missing.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError || !m.Authoritative {
+		t.Errorf("expected an authoritative NXDOMAIN, got %s", m)
+	}
+	checkRecords(t, "answer", m.Answer)
+	checkRecords(t, "authority", m.Ns, "example.org. 300 IN SOA ns1.example.org. admin.example.org. 1 3600 600 86400 300")
+}
+
+func TestQueryNoData(t *testing.T) {
+	setupSQLite(t)
+
+	m := query(t, "www.example.org.", dns.TypeMX)
+	if m.Rcode != dns.RcodeSuccess || !m.Authoritative {
+		t.Errorf("expected an authoritative NOERROR, got %s", m)
+	}
+	checkRecords(t, "answer", m.Answer)
+	checkRecords(t, "authority", m.Ns, "example.org. 300 IN SOA ns1.example.org. admin.example.org. 1 3600 600 86400 300")
+}
+
+func TestQueryCNAME(t *testing.T) {
+	setupSQLite(t)
+
+	m := query(t, "alias.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected NOERROR, got %s", m)
+	}
+	checkRecords(t, "answer", m.Answer,
+		"alias.example.org. 3600 IN CNAME www.example.org.",
+		"www.example.org. 3600 IN A 192.0.2.1")
+}
+
+func TestQueryWildcard(t *testing.T) {
+	setupSQLite(t)
+
+	m := query(t, "host.wild.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected NOERROR, got %s", m)
+	}
+	checkRecords(t, "answer", m.Answer, "host.wild.example.org. 3600 IN A 192.0.2.2")
+}
+
+func TestQueryReferral(t *testing.T) {
+	setupSQLite(t)
+
+	m := query(t, "www.sub.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || m.Authoritative {
+		t.Errorf("expected a non authoritative NOERROR, got %s", m)
+	}
+	checkRecords(t, "answer", m.Answer)
+	checkRecords(t, "authority", m.Ns, "sub.example.org. 3600 IN NS ns.sub.example.org.")
+	checkRecords(t, "additional", m.Extra, "ns.sub.example.org. 3600 IN A 192.0.2.3")
+}
+
+func TestQueryRefused(t *testing.T) {
+	setupSQLite(t)
+
+	m := query(t, "www.example.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeRefused || m.Authoritative {
+		t.Errorf("expected a non authoritative REFUSED, got %s", m)
+	}
+}
+
+func TestAXFR(t *testing.T) {
+	setupSQLite(t)
+
+	request := new(dns.Msg)
+	request.SetAxfr("example.org.")
+
+	writer := newTestWriter("tcp")
+	Handler(writer, request)
+
+	var rrs []dns.RR
+	for _, m := range writer.msgs {
+		if m.Rcode != dns.RcodeSuccess {
+			t.Fatalf("expected NOERROR, got %s", m)
+		}
+		rrs = append(rrs, m.Answer...)
+	}
+
+	if len(rrs) != len(testRecords)+1 {
+		t.Fatalf("expected %d records, got %v", len(testRecords)+1, rrs)
+	}
+	for _, rr := range []dns.RR{rrs[0], rrs[len(rrs)-1]} {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			t.Errorf("expected the transfer to start and end with the SOA, got %s", rr)
+		}
+	}
+}
+
+func TestAXFRNotAuth(t *testing.T) {
+	setupSQLite(t)
+
+	request := new(dns.Msg)
+	request.SetAxfr("example.com.")
+
+	writer := newTestWriter("tcp")
+	Handler(writer, request)
+
+	if len(writer.msgs) != 1 || writer.msgs[0].Rcode != dns.RcodeNotAuth {
+		t.Errorf("expected a single NOTAUTH response, got %v", writer.msgs)
+	}
+}
+
+// Send an IXFR for example.org. from serial over TCP and return the records
+// of the answer.
+func ixfr(t *testing.T, serial uint32) (rrs []dns.RR) {
+	request := new(dns.Msg)
+	request.SetIxfr("example.org.", serial, "ns1.example.org.", "admin.example.org.")
+
+	writer := newTestWriter("tcp")
+	Handler(writer, request)
+
+	for _, m := range writer.msgs {
+		if m.Rcode != dns.RcodeSuccess {
+			t.Fatalf("expected NOERROR, got %s", m)
+		}
+		rrs = append(rrs, m.Answer...)
+	}
+	return rrs
+}
+
+func TestIXFR(t *testing.T) {
+	conn := setupSQLite(t)
+
+	// Up to date
+	if rrs := ixfr(t, 1); len(rrs) != 1 || rrs[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("expected only the SOA for an up to date client, got %v", rrs)
+	}
+
+	// No history yet, the whole zone is sent and the journal started
+	if rrs := ixfr(t, 0); len(rrs) != len(testRecords)+1 {
+		t.Errorf("expected the whole zone without history, got %v", rrs)
+	}
+
+	conn.MustExec("UPDATE domains SET serial = 2")
+	conn.MustExec("UPDATE records SET data = 'ns1.example.org. admin.example.org. 2 3600 600 86400 300' WHERE recordset_id = '0'")
+	conn.MustExec("UPDATE records SET data = '192.0.2.10' WHERE data = '192.0.2.1'")
+
+	rrs := ixfr(t, 1)
+	checkRecords(t, "ixfr", rrs,
+		"example.org. 3600 IN SOA ns1.example.org. admin.example.org. 2 3600 600 86400 300",
+		"example.org. 3600 IN SOA ns1.example.org. admin.example.org. 1 3600 600 86400 300",
+		"www.example.org. 3600 IN A 192.0.2.1",
+		"example.org. 3600 IN SOA ns1.example.org. admin.example.org. 2 3600 600 86400 300",
+		"www.example.org. 3600 IN A 192.0.2.10",
+		"example.org. 3600 IN SOA ns1.example.org. admin.example.org. 2 3600 600 86400 300")
+}
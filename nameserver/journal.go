@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/miekg/dns"
+)
+
+// Number of changes kept per zone for IXFR.
+const maxJournalEntries = 16
+
+// Number of records the journal holds across all zones, counting both their
+// current contents and their changes.
+const maxJournalRecords = 1000000
+
+// The changes made to a zone between two serials.
+type journalEntry struct {
+	From    *dns.SOA
+	To      *dns.SOA
+	Deleted []dns.RR
+	Added   []dns.RR
+}
+
+// The records of a zone at the latest serial we have seen, by hash, and the
+// changes that led up to it.
+type zoneJournal struct {
+	soa     *dns.SOA
+	records map[uint64]dns.RR
+	entries []journalEntry
+	size    int
+}
+
+// A Journal derives the changes made to zones by comparing their contents
+// each time a new serial is seen, as Designate keeps no history itself. Only
+// zones a secondary asked an IXFR for, or configured to be, are journaled.
+type Journal struct {
+	lock   sync.Mutex
+	zones  map[string]*zoneJournal
+	wanted map[string]bool
+	size   int
+	limit  int
+}
+
+var journal = NewJournal()
+
+func NewJournal() *Journal {
+	return &Journal{
+		zones:  make(map[string]*zoneJournal),
+		wanted: make(map[string]bool),
+		limit:  maxJournalRecords,
+	}
+}
+
+// Journal the zones configured for IXFR from the start.
+func SetupJournal(cfg *config.Configuration) {
+	for _, zone := range cfg.TransferZones {
+		if zone.Ixfr {
+			journal.Want(zone.Name)
+		}
+	}
+}
+
+// Start journaling a zone, unless it was found too large to.
+func (j *Journal) Want(zoneName string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	name := dns.Fqdn(strings.ToLower(zoneName))
+	if _, ok := j.wanted[name]; !ok {
+		j.wanted[name] = true
+	}
+}
+
+// Whether a zone is to be journaled.
+func (j *Journal) Wants(zone db.Zone) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.wanted[dns.Fqdn(strings.ToLower(zone.Name))]
+}
+
+// Record the current contents of a zone, journaling the difference with the
+// contents recorded for the previous serial.
+func (j *Journal) Update(zone db.Zone, soa *dns.SOA, records []dns.RR) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	current := make(map[uint64]dns.RR, len(records))
+	for _, rr := range records {
+		current[hashRR(rr)] = rr
+	}
+
+	zj, ok := j.zones[zone.Id]
+	if !ok || !SerialGreater(soa.Serial, zj.soa.Serial) {
+		// First sighting, or the serial went backwards and the history is
+		// of no use anymore
+		if !ok || soa.Serial != zj.soa.Serial {
+			j.drop(zone)
+			j.zones[zone.Id] = &zoneJournal{soa: soa, records: current, size: len(current)}
+			j.size += len(current)
+			j.fit(zone)
+		}
+		return
+	}
+
+	entry := journalEntry{From: zj.soa, To: soa}
+	for key, rr := range zj.records {
+		if _, ok := current[key]; !ok {
+			entry.Deleted = append(entry.Deleted, rr)
+		}
+	}
+	for key, rr := range current {
+		if _, ok := zj.records[key]; !ok {
+			entry.Added = append(entry.Added, rr)
+		}
+	}
+
+	j.size += len(current) - len(zj.records) + entry.size()
+	zj.size += len(current) - len(zj.records) + entry.size()
+
+	zj.entries = append(zj.entries, entry)
+	zj.soa, zj.records = soa, current
+
+	if len(zj.entries) > maxJournalEntries {
+		j.trim(zj)
+	}
+	j.fit(zone)
+}
+
+// Number of records a change holds.
+func (entry journalEntry) size() int {
+	return len(entry.Deleted) + len(entry.Added)
+}
+
+// Forget the oldest change of a zone.
+func (j *Journal) trim(zj *zoneJournal) {
+	n := zj.entries[0].size()
+	zj.entries = zj.entries[1:]
+	zj.size -= n
+	j.size -= n
+}
+
+// Forget a zone.
+func (j *Journal) drop(zone db.Zone) {
+	if zj, ok := j.zones[zone.Id]; ok {
+		j.size -= zj.size
+		delete(j.zones, zone.Id)
+	}
+}
+
+// Keep the journal within its limit by forgetting the oldest changes of a
+// zone, and the zone itself for good when its records alone do not fit.
+func (j *Journal) fit(zone db.Zone) {
+	zj := j.zones[zone.Id]
+	for j.size > j.limit && len(zj.entries) > 0 {
+		j.trim(zj)
+	}
+
+	if j.size > j.limit {
+		log.Warn("Zone %s is too large to journal, IXFR falls back to AXFR", zone.Name)
+		j.drop(zone)
+		j.wanted[dns.Fqdn(strings.ToLower(zone.Name))] = false
+	}
+}
+
+// Hash a record by its presentation format.
+func hashRR(rr dns.RR) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(rr.String()))
+	return h.Sum64()
+}
+
+// Whether the journal has recorded a zone at serial.
+func (j *Journal) Has(zone db.Zone, serial uint32) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	zj, ok := j.zones[zone.Id]
+	return ok && zj.soa.Serial == serial
+}
+
+// Get the changes made to a zone from serial up to serial to, if the journal
+// reaches back that far and is up to date.
+func (j *Journal) Changes(zone db.Zone, serial uint32, to uint32) (entries []journalEntry, ok bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	zj, ok := j.zones[zone.Id]
+	if !ok || zj.soa.Serial != to {
+		return nil, false
+	}
+	if zj.soa.Serial == serial {
+		return nil, true
+	}
+
+	for i, entry := range zj.entries {
+		if entry.From.Serial == serial {
+			return append([]journalEntry{}, zj.entries[i:]...), true
+		}
+	}
+
+	return nil, false
+}
+
+// Record the contents of a zone in source in the journal, when the zone is
+// journaled and its serial is not recorded already. Journaled zones are
+// snapshot whenever their serial is seen to change, so that IXFR has the
+// history to answer from.
+func Snapshot(source db.Backend, zone db.Zone) (err error) {
+	if !journal.Wants(zone) || journal.Has(zone, uint32(zone.Serial)) {
+		return nil
+	}
+
+	soa, records, err := resolveZone(source, zone)
+	if err != nil {
+		log.Error("Error reading %s for the journal: %s", zone.Name, err)
+		return err
+	}
+
+	journal.Update(zone, soa, records)
+	return nil
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ekarlso/gomdns/db"
+	"github.com/miekg/dns"
+)
+
+var journalZone = db.Zone{Id: "1", Name: "example.org."}
+
+func parseRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func newSOA(t *testing.T, serial uint32) *dns.SOA {
+	return parseRR(t, fmt.Sprintf("example.org. 3600 IN SOA ns1.example.org. admin.example.org. %d 3600 600 86400 300", serial)).(*dns.SOA)
+}
+
+// The records of example.org. with an A record for each of names.
+func zoneRecords(t *testing.T, names ...string) (records []dns.RR) {
+	for _, name := range names {
+		records = append(records, parseRR(t, name+".example.org. 3600 IN A 192.0.2.1"))
+	}
+	return records
+}
+
+// Check that rrs are the A records of names, in any order.
+func checkNames(t *testing.T, what string, rrs []dns.RR, names ...string) {
+	want := make(map[string]bool)
+	for _, name := range names {
+		want[name+".example.org."] = true
+	}
+
+	if len(rrs) != len(want) {
+		t.Errorf("%s: expected %v, got %v", what, names, rrs)
+		return
+	}
+	for _, rr := range rrs {
+		if !want[rr.Header().Name] {
+			t.Errorf("%s: expected %v, got %v", what, names, rrs)
+			return
+		}
+	}
+}
+
+func TestSerialGreater(t *testing.T) {
+	tests := []struct {
+		a, b    uint32
+		greater bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{1, 1, false},
+		{0, 4294967295, true},
+		{4294967295, 0, false},
+		{2147483647, 0, true},
+		{2147483648, 0, false},
+	}
+
+	for _, test := range tests {
+		if SerialGreater(test.a, test.b) != test.greater {
+			t.Errorf("SerialGreater(%d, %d) should be %v", test.a, test.b, test.greater)
+		}
+	}
+}
+
+func TestJournalChanges(t *testing.T) {
+	j := NewJournal()
+	j.Update(journalZone, newSOA(t, 1), zoneRecords(t, "a"))
+	j.Update(journalZone, newSOA(t, 2), zoneRecords(t, "a", "b"))
+	j.Update(journalZone, newSOA(t, 3), zoneRecords(t, "b", "c"))
+
+	entries, ok := j.Changes(journalZone, 1, 3)
+	if !ok || len(entries) != 2 {
+		t.Fatalf("expected 2 changes since 1, got %v %v", entries, ok)
+	}
+	if entries[0].From.Serial != 1 || entries[0].To.Serial != 2 || entries[1].From.Serial != 2 || entries[1].To.Serial != 3 {
+		t.Errorf("expected changes 1 to 2 and 2 to 3, got %v", entries)
+	}
+	checkNames(t, "deleted from 1 to 2", entries[0].Deleted)
+	checkNames(t, "added from 1 to 2", entries[0].Added, "b")
+	checkNames(t, "deleted from 2 to 3", entries[1].Deleted, "a")
+	checkNames(t, "added from 2 to 3", entries[1].Added, "c")
+
+	if entries, ok := j.Changes(journalZone, 2, 3); !ok || len(entries) != 1 {
+		t.Errorf("expected 1 change since 2, got %v %v", entries, ok)
+	}
+	if entries, ok := j.Changes(journalZone, 3, 3); !ok || len(entries) != 0 {
+		t.Errorf("expected no changes since 3, got %v %v", entries, ok)
+	}
+	if _, ok := j.Changes(journalZone, 1, 4); ok {
+		t.Errorf("expected no changes up to a serial not journaled yet")
+	}
+	if _, ok := j.Changes(journalZone, 0, 3); ok {
+		t.Errorf("expected no changes since a serial never seen")
+	}
+}
+
+func TestJournalSameSerial(t *testing.T) {
+	j := NewJournal()
+	j.Update(journalZone, newSOA(t, 1), zoneRecords(t, "a"))
+	j.Update(journalZone, newSOA(t, 2), zoneRecords(t, "b"))
+	j.Update(journalZone, newSOA(t, 2), zoneRecords(t, "c"))
+
+	entries, ok := j.Changes(journalZone, 1, 2)
+	if !ok || len(entries) != 1 {
+		t.Fatalf("expected the history to be kept, got %v %v", entries, ok)
+	}
+	checkNames(t, "added", entries[0].Added, "b")
+}
+
+func TestJournalSerialWrap(t *testing.T) {
+	j := NewJournal()
+	j.Update(journalZone, newSOA(t, 4294967295), zoneRecords(t, "a"))
+	j.Update(journalZone, newSOA(t, 1), zoneRecords(t, "b"))
+
+	entries, ok := j.Changes(journalZone, 4294967295, 1)
+	if !ok || len(entries) != 1 {
+		t.Fatalf("expected a change across the wrap, got %v %v", entries, ok)
+	}
+	checkNames(t, "deleted", entries[0].Deleted, "a")
+	checkNames(t, "added", entries[0].Added, "b")
+}
+
+func TestJournalSerialBackwards(t *testing.T) {
+	j := NewJournal()
+	j.Update(journalZone, newSOA(t, 5), zoneRecords(t, "a"))
+	j.Update(journalZone, newSOA(t, 6), zoneRecords(t, "b"))
+	j.Update(journalZone, newSOA(t, 3), zoneRecords(t, "c"))
+
+	if !j.Has(journalZone, 3) {
+		t.Errorf("expected the journal to restart at serial 3")
+	}
+	if _, ok := j.Changes(journalZone, 5, 3); ok {
+		t.Errorf("expected no changes across a serial going backwards")
+	}
+	if _, ok := j.Changes(journalZone, 6, 3); ok {
+		t.Errorf("expected the history to be dropped")
+	}
+}
+
+func TestJournalHistoryLimit(t *testing.T) {
+	j := NewJournal()
+
+	last := uint32(maxJournalEntries + 3)
+	for serial := uint32(1); serial <= last; serial++ {
+		j.Update(journalZone, newSOA(t, serial), zoneRecords(t, fmt.Sprintf("host%d", serial)))
+	}
+
+	oldest := last - maxJournalEntries
+	if _, ok := j.Changes(journalZone, oldest-1, last); ok {
+		t.Errorf("expected no changes since %d, older than the history", oldest-1)
+	}
+	entries, ok := j.Changes(journalZone, oldest, last)
+	if !ok || len(entries) != maxJournalEntries {
+		t.Errorf("expected %d changes since %d, got %d %v", maxJournalEntries, oldest, len(entries), ok)
+	}
+}
+
+func TestJournalSizeLimit(t *testing.T) {
+	j := NewJournal()
+	j.limit = 5
+	j.Want(journalZone.Name)
+
+	j.Update(journalZone, newSOA(t, 1), zoneRecords(t, "a", "b"))
+	j.Update(journalZone, newSOA(t, 2), zoneRecords(t, "c", "d"))
+	if _, ok := j.Changes(journalZone, 1, 2); ok {
+		t.Errorf("expected the oldest change to be dropped to stay within the limit")
+	}
+	if !j.Has(journalZone, 2) || j.size > j.limit {
+		t.Errorf("expected serial 2 to be kept within the limit, holding %d records", j.size)
+	}
+
+	j.Update(journalZone, newSOA(t, 3), zoneRecords(t, "a", "b", "c", "d", "e", "f"))
+	if j.Has(journalZone, 3) || j.size != 0 {
+		t.Errorf("expected a zone over the limit to be dropped, holding %d records", j.size)
+	}
+	if j.Wants(journalZone) {
+		t.Errorf("expected a zone over the limit to no longer be journaled")
+	}
+
+	j.Want(journalZone.Name)
+	if j.Wants(journalZone) {
+		t.Errorf("expected a zone over the limit to stay unjournaled")
+	}
+}
+
+func TestIxfrRecords(t *testing.T) {
+	j := NewJournal()
+	j.Update(journalZone, newSOA(t, 1), zoneRecords(t, "a"))
+	j.Update(journalZone, newSOA(t, 2), zoneRecords(t, "b"))
+	j.Update(journalZone, newSOA(t, 3), zoneRecords(t, "b", "c"))
+
+	entries, _ := j.Changes(journalZone, 1, 3)
+	rrs := ixfrRecords(newSOA(t, 3), entries)
+
+	// 3, 1 -a, 2 +b, 2, 3 +c, 3
+	want := []string{"SOA 3", "SOA 1", "a", "SOA 2", "b", "SOA 2", "SOA 3", "c", "SOA 3"}
+	if len(rrs) != len(want) {
+		t.Fatalf("expected %v, got %v", want, rrs)
+	}
+	for i, rr := range rrs {
+		var got string
+		if soa, ok := rr.(*dns.SOA); ok {
+			got = fmt.Sprintf("SOA %d", soa.Serial)
+		} else {
+			got = dns.SplitDomainName(rr.Header().Name)[0]
+		}
+		if got != want[i] {
+			t.Errorf("record %d: expected %s, got %s", i, want[i], got)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/cache"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+)
+
+var (
+	notifyLock     sync.RWMutex
+	notifyHandlers []func(zone string)
+	notifyZones    = make(map[string]bool)
+)
+
+// Register a function to call with the zone name whenever a verified NOTIFY
+// is received for one of our zones. Functions are called one after the
+// other in the order they were registered.
+func OnNotify(fn func(zone string)) {
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+
+	notifyHandlers = append(notifyHandlers, fn)
+}
+
+// Accept NOTIFY for a zone that is not served yet, such as a secondary zone
+// still to be transferred.
+func AcceptNotify(zoneName string) {
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+
+	notifyZones[dns.Fqdn(strings.ToLower(zoneName))] = true
+}
+
+// Whether NOTIFY is accepted for a zone that is not served.
+func acceptsNotify(zoneName string) bool {
+	notifyLock.RLock()
+	defer notifyLock.RUnlock()
+
+	return notifyZones[zoneName]
+}
+
+// Handle an inbound NOTIFY as per RFC 1996. Only NOTIFY signed with one of
+// our TSIG keys is accepted; the TSIG itself was checked by the Handler.
+func ResolveNotify(writer dns.ResponseWriter, request *dns.Msg) (err error) {
+	query := request.Question[0]
+	name := strings.ToLower(query.Name)
+
+	m := new(dns.Msg)
+
+	if request.IsTsig() == nil {
+		log.Warn("Refused unsigned NOTIFY for %s from %s", name, writer.RemoteAddr())
+		stats.AddToMeter("notify.refused", 1)
+
+		m.SetRcode(request, dns.RcodeRefused)
+		return writer.WriteMsg(m)
+	}
+
+	if query.Qtype != dns.TypeSOA {
+		m.SetRcode(request, dns.RcodeFormatError)
+		signResponse(request, m)
+		return writer.WriteMsg(m)
+	}
+
+	zone, err := backend.GetZoneByName(name)
+	if err == sql.ErrNoRows && acceptsNotify(name) {
+		zone, err = db.Zone{Name: name}, nil
+	}
+	if err == sql.ErrNoRows {
+		m.SetRcode(request, dns.RcodeNotAuth)
+		signResponse(request, m)
+		return writer.WriteMsg(m)
+	} else if err != nil {
+		m.SetRcode(request, dns.RcodeServerFailure)
+		signResponse(request, m)
+		writer.WriteMsg(m)
+		return err
+	}
+
+	log.Info("Received NOTIFY for %s from %s", zone.Name, writer.RemoteAddr())
+	stats.AddToMeter("notify.received", 1)
+
+	m.SetReply(request)
+	m.Authoritative = true
+	signResponse(request, m)
+
+	if err = writer.WriteMsg(m); err != nil {
+		return err
+	}
+
+	notifyLock.RLock()
+	handlers := append([]func(string){}, notifyHandlers...)
+	notifyLock.RUnlock()
+
+	// Purging the cache reloads zones held in memory, which must be done
+	// before the handlers pass the NOTIFY on
+	go func() {
+		cache.PurgeZone(zone.Name)
+		for _, fn := range handlers {
+			fn(zone.Name)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Send a NOTIFY for a zone signed with our key, returning the response.
+func notify(t *testing.T, zoneName string) *dns.Msg {
+	request := new(dns.Msg)
+	request.SetNotify(zoneName)
+	request.SetTsig("notify-key.", dns.HmacSHA256, 300, time.Now().Unix())
+
+	writer := newTestWriter("udp")
+	Handler(writer, request)
+
+	if len(writer.msgs) != 1 {
+		t.Fatalf("expected one response, got %d", len(writer.msgs))
+	}
+	return writer.msgs[0]
+}
+
+func TestNotifyPendingZone(t *testing.T) {
+	stats.NameServerStats = metrics.NewRegistry()
+	tsigKeys = map[string]tsigKey{"notify-key.": {name: "notify-key.", algorithm: dns.HmacSHA256, secret: "c2VjcmV0"}}
+	SetBackend(newFakeBackend(), nil)
+	notifyZones, notifyHandlers = make(map[string]bool), nil
+
+	notified := make(chan string, 1)
+	OnNotify(func(zone string) {
+		if zone == "pending.example." {
+			notified <- zone
+		}
+	})
+
+	if m := notify(t, "pending.example."); m.Rcode != dns.RcodeNotAuth {
+		t.Errorf("expected NOTAUTH for a zone we do not serve, got %s", dns.RcodeToString[m.Rcode])
+	}
+
+	AcceptNotify("Pending.Example")
+	if m := notify(t, "pending.example."); m.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected NOERROR for a zone still to be transferred, got %s", dns.RcodeToString[m.Rcode])
+	}
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the NOTIFY handlers to run")
+	}
+}
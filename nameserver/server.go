@@ -20,8 +20,6 @@
 package nameserver
 
 import (
-	"strings"
-
 	log "code.google.com/p/log4go"
 	"github.com/ekarlso/gomdns/config"
 	"github.com/miekg/dns"
@@ -39,36 +37,37 @@ func NewServer(cfg *config.Configuration) *NameServer {
 }
 
 func (s *NameServer) ListenAndServe() {
-	var name, secret string
+	secrets, err := loadTsigKeys(&s.config)
+	if err != nil {
+		log.Crashf("Invalid TSIG configuration: %s", err)
+	}
+
+	if err := loadTransferPolicy(&s.config); err != nil {
+		log.Crashf("Invalid zone transfer configuration: %s", err)
+	}
 
-	if s.config.NameServerSecret != "" {
-		a := strings.SplitN(s.config.NameServerSecret, ":", 2)
-		name, secret = dns.Fqdn(a[0]), a[1] // fqdn the name, which everybody forgets...
+	if backend == nil {
+		log.Crash("No backend to serve zones from")
 	}
 
 	dns.HandleFunc(".", Handler)
-	go s.Serve("tcp", s.config.NameServerListen(), name, secret)
-	go s.Serve("udp", s.config.NameServerListen(), name, secret)
+	go s.Serve("tcp", s.config.NameServerListen(), secrets)
+	go s.Serve("udp", s.config.NameServerListen(), secrets)
 
 	s.stopped = false
 }
 
-func (s *NameServer) Serve(net, addr, name, secret string) {
+func (s *NameServer) Serve(net, addr string, secrets map[string]string) {
 	log.Info("Starting NameServer on %s - %s", net, addr)
 
-	switch name {
-	case "":
-		server := &dns.Server{Addr: addr, Net: net, TsigSecret: nil}
-		err := server.ListenAndServe()
-		if err != nil {
-			log.Crash("Failed to setup the "+net+" server: %s\n", err.Error())
-		}
-	default:
-		server := &dns.Server{Addr: addr, Net: net, TsigSecret: map[string]string{name: secret}}
-		err := server.ListenAndServe()
-		if err != nil {
-			log.Crash("Failed to setup the "+net+" server: %s\n", err.Error())
-		}
+	if len(secrets) == 0 {
+		secrets = nil
+	}
+
+	server := &dns.Server{Addr: addr, Net: net, TsigSecret: secrets}
+	err := server.ListenAndServe()
+	if err != nil {
+		log.Crash("Failed to setup the "+net+" server: %s\n", err.Error())
 	}
 }
 
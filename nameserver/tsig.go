@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+)
+
+// A TSIG key and the zones it may be used for, any zone when there are none.
+// Keys without an algorithm accept any supported one.
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    string
+	zones     []string
+}
+
+var tsigKeys = make(map[string]tsigKey)
+
+// The algorithm of keys that accept any supported one.
+const anyAlgorithm = "any"
+
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Set up the TSIG keys from the configuration, returning the secrets by key
+// name for the servers. The legacy "name:secret" NameServerSecret accepts
+// any supported algorithm, as it always has.
+func loadTsigKeys(cfg *config.Configuration) (secrets map[string]string, err error) {
+	keyConfigs := cfg.TsigKeys
+
+	if cfg.NameServerSecret != "" {
+		a := strings.SplitN(cfg.NameServerSecret, ":", 2)
+		if len(a) != 2 {
+			return nil, errors.New("secret must be given as name:secret")
+		}
+		keyConfigs = append(keyConfigs, config.TsigConfig{Name: a[0], Algorithm: anyAlgorithm, Secret: a[1]})
+	}
+
+	keys := make(map[string]tsigKey)
+	secrets = make(map[string]string)
+
+	for _, kc := range keyConfigs {
+		name := dns.Fqdn(strings.ToLower(kc.Name)) // fqdn the name, which everybody forgets...
+
+		algorithm := strings.ToLower(kc.Algorithm)
+		if algorithm == anyAlgorithm {
+			algorithm = ""
+		} else if algorithm == "" {
+			algorithm = "hmac-sha256"
+		} else if !strings.HasPrefix(algorithm, "hmac-") {
+			algorithm = "hmac-" + algorithm
+		}
+
+		key := tsigKey{name: name, algorithm: tsigAlgorithms[algorithm], secret: kc.Secret}
+		if algorithm != "" && key.algorithm == "" {
+			return nil, fmt.Errorf("key %s has unsupported algorithm %s", name, kc.Algorithm)
+		}
+		if _, ok := keys[name]; ok {
+			return nil, fmt.Errorf("key %s is defined twice", name)
+		}
+
+		for _, zone := range kc.Zones {
+			key.zones = append(key.zones, dns.Fqdn(strings.ToLower(zone)))
+		}
+
+		keys[name] = key
+		secrets[name] = kc.Secret
+	}
+
+	tsigKeys = keys
+	return secrets, nil
+}
+
+// Get the algorithm and secret of a TSIG key, for signing outgoing messages.
+// Keys accepting any algorithm sign with hmac-sha256.
+func TsigKey(name string) (algorithm string, secret string, ok bool) {
+	key, ok := tsigKeys[dns.Fqdn(strings.ToLower(name))]
+	if ok && key.algorithm == "" {
+		return dns.HmacSHA256, key.secret, ok
+	}
+	return key.algorithm, key.secret, ok
+}
+
+// Check the TSIG of a signed request: the key must be known, used with its
+// algorithm and for a zone it is bound to, and the signature must verify.
+// Failures are answered with NOTAUTH and the TSIG error, or REFUSED for a
+// key used outside its zones, and false is returned.
+func checkTsig(writer dns.ResponseWriter, request *dns.Msg) bool {
+	tsig := request.IsTsig()
+	if tsig == nil {
+		return true
+	}
+
+	key, ok := tsigKeys[strings.ToLower(tsig.Hdr.Name)]
+	if !ok || !key.accepts(tsig.Algorithm) {
+		return refuseTsig(writer, request, dns.RcodeBadKey)
+	}
+
+	switch writer.TsigStatus() {
+	case nil:
+	case dns.ErrSecret:
+		return refuseTsig(writer, request, dns.RcodeBadKey)
+	case dns.ErrTime:
+		return refuseTsig(writer, request, dns.RcodeBadTime)
+	default:
+		return refuseTsig(writer, request, dns.RcodeBadSig)
+	}
+
+	if !key.allows(request.Question[0].Name) {
+		log.Warn("Key %s is not bound to %s", key.name, request.Question[0].Name)
+		stats.AddToMeter("tsig.refused", 1)
+
+		m := new(dns.Msg)
+		m.SetRcode(request, dns.RcodeRefused)
+		signResponse(request, m)
+		writer.WriteMsg(m)
+		return false
+	}
+
+	return true
+}
+
+// Check whether a key may be used with an algorithm.
+func (k tsigKey) accepts(algorithm string) bool {
+	if k.algorithm != "" {
+		return strings.EqualFold(algorithm, k.algorithm)
+	}
+
+	for _, supported := range tsigAlgorithms {
+		if strings.EqualFold(algorithm, supported) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a key may be used for a name.
+func (k tsigKey) allows(name string) bool {
+	if len(k.zones) == 0 {
+		return true
+	}
+
+	name = strings.ToLower(name)
+	for _, zone := range k.zones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer a request whose TSIG did not check out with NOTAUTH, carrying the
+// TSIG error in an unsigned TSIG record as per RFC 2845 section 4.5.
+func refuseTsig(writer dns.ResponseWriter, request *dns.Msg, tsigError uint16) bool {
+	tsig := request.IsTsig()
+
+	log.Warn("TSIG %s from %s failed: %s", tsig.Hdr.Name, writer.RemoteAddr(), dns.RcodeToString[int(tsigError)])
+	stats.AddToMeter("tsig.failed", 1)
+
+	m := new(dns.Msg)
+	m.SetRcode(request, dns.RcodeNotAuth)
+	m.Extra = append(m.Extra, &dns.TSIG{
+		Hdr:        dns.RR_Header{Name: tsig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm:  tsig.Algorithm,
+		TimeSigned: uint64(time.Now().Unix()),
+		Fudge:      tsig.Fudge,
+		OrigId:     request.Id,
+		Error:      tsigError,
+	})
+
+	buf, err := m.Pack()
+	if err != nil {
+		log.Error("Error packing TSIG error response: %s", err)
+		return false
+	}
+
+	writer.Write(buf)
+	return false
+}
+
+// Room the TSIG of the response to a signed request takes, to be kept free
+// when fitting the response to the size the client can take.
+func tsigSize(request *dns.Msg) int {
+	tsig := request.IsTsig()
+	if tsig == nil {
+		return 0
+	}
+
+	macSize := 64
+	switch strings.ToLower(tsig.Algorithm) {
+	case dns.HmacSHA1:
+		macSize = 20
+	case dns.HmacSHA224:
+		macSize = 28
+	case dns.HmacSHA256:
+		macSize = 32
+	case dns.HmacSHA384:
+		macSize = 48
+	}
+
+	// Owner and algorithm names are never compressed, then the type, class,
+	// TTL and RDLENGTH, time signed, fudge, MAC size, MAC, original id,
+	// error and other length
+	return len(tsig.Hdr.Name) + 1 + 10 + len(tsig.Algorithm) + 1 + 6 + 2 + 2 + macSize + 2 + 2 + 2
+}
+
+// Have the response to a signed request signed with the same key.
+func signResponse(request *dns.Msg, m *dns.Msg) {
+	if tsig := request.IsTsig(); tsig != nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+}
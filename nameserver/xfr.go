@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"strings"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+)
+
+// Room left in each transfer message for the header, question and TSIG.
+const xfrMessageSize = dns.MaxMsgSize - 1024
+
+// Handle an AXFR by streaming the whole zone from the database, spread over
+// as many messages as it takes.
+func ResolveXFR(query dns.Question, writer dns.ResponseWriter, request *dns.Msg) (err error) {
+	if !transfers.Allowed(query.Name, writer, request) {
+		return refuseXFR(writer, request, dns.RcodeRefused)
+	}
+
+	zone, err := xfrBackend.GetZoneByName(strings.ToLower(query.Name))
+	if err == sql.ErrNoRows {
+		return refuseXFR(writer, request, dns.RcodeNotAuth)
+	} else if err != nil {
+		log.Error("Error getting zone %s for XFR: %s", query.Name, err)
+		return refuseXFR(writer, request, dns.RcodeServerFailure)
+	}
+
+	soa, err := resolveZoneSOA(xfrBackend, zone)
+	if err != nil {
+		log.Error("Error getting SOA of %s for XFR: %s", zone.Name, err)
+		return refuseXFR(writer, request, dns.RcodeServerFailure)
+	}
+
+	stats.AddToMeter("xfr.axfr", 1)
+	return streamZone(writer, request, zone, soa)
+}
+
+// Stream a whole zone between its SOA records, one RRSet at a time.
+func streamZone(writer dns.ResponseWriter, request *dns.Msg, zone db.Zone, soa *dns.SOA) (err error) {
+	stream := newXFRStream(writer, request)
+	stream.Add(soa)
+
+	err = xfrBackend.IterateZoneRecordSets(zone, "SOA", func(rrSet db.RecordSet) error {
+		records, err := resolveRRSet(zone, rrSet)
+		if err != nil {
+			return err
+		}
+
+		for _, rr := range records {
+			if err := stream.Add(rr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// The client sees the transfer end without the closing SOA
+		log.Error("Error streaming %s for XFR: %s", zone.Name, err)
+		stream.Close()
+		return err
+	}
+
+	stream.Add(soa)
+	return stream.Close()
+}
+
+// Handle an IXFR as per RFC 1995, sending the changes since the serial the
+// client has when the journal reaches back that far and the whole zone
+// otherwise.
+func ResolveIXFR(query dns.Question, writer dns.ResponseWriter, request *dns.Msg) (err error) {
+	if !transfers.Allowed(query.Name, writer, request) {
+		return refuseXFR(writer, request, dns.RcodeRefused)
+	}
+
+	zone, err := xfrBackend.GetZoneByName(strings.ToLower(query.Name))
+	if err == sql.ErrNoRows {
+		return refuseXFR(writer, request, dns.RcodeNotAuth)
+	} else if err != nil {
+		log.Error("Error getting zone %s for IXFR: %s", query.Name, err)
+		return refuseXFR(writer, request, dns.RcodeServerFailure)
+	}
+
+	var client *dns.SOA
+	if len(request.Ns) > 0 {
+		client, _ = request.Ns[0].(*dns.SOA)
+	}
+	if client == nil {
+		return refuseXFR(writer, request, dns.RcodeFormatError)
+	}
+
+	soa, err := resolveZoneSOA(xfrBackend, zone)
+	if err != nil {
+		log.Error("Error getting SOA of %s for IXFR: %s", zone.Name, err)
+		return refuseXFR(writer, request, dns.RcodeServerFailure)
+	}
+
+	// Clients that are up to date, or asking over UDP where the changes
+	// would not fit, only get the current SOA
+	_, udp := writer.RemoteAddr().(*net.UDPAddr)
+	if udp || !SerialGreater(soa.Serial, client.Serial) {
+		m := new(dns.Msg)
+		m.SetReply(request)
+		m.Authoritative = true
+		m.Answer = []dns.RR{soa}
+		signResponse(request, m)
+		return writer.WriteMsg(m)
+	}
+
+	// Zones are journaled from their first IXFR on, as their serial
+	// changes. This catches up when the journal has an earlier serial to
+	// derive the changes from, and starts the journal otherwise.
+	journal.Want(zone.Name)
+	if err = Snapshot(xfrBackend, zone); err != nil {
+		return refuseXFR(writer, request, dns.RcodeServerFailure)
+	}
+
+	entries, ok := journal.Changes(zone, client.Serial, soa.Serial)
+	if !ok {
+		log.Debug("No history for %s since %d, falling back to AXFR", zone.Name, client.Serial)
+		stats.AddToMeter("xfr.ixfr.fallback", 1)
+
+		return streamZone(writer, request, zone, soa)
+	}
+
+	stats.AddToMeter("xfr.ixfr", 1)
+	return sendXFR(writer, request, ixfrRecords(soa, entries))
+}
+
+// Get the SOA of a zone from source.
+func resolveZoneSOA(source db.Backend, zone db.Zone) (soa *dns.SOA, err error) {
+	rrSet, err := source.GetRecordSet(zone, zone.Name, "SOA")
+	if err != nil {
+		return nil, err
+	}
+
+	soas, err := resolveRRSet(zone, rrSet)
+	if err != nil {
+		return nil, err
+	}
+	if len(soas) == 0 {
+		return nil, errors.New("zone " + zone.Name + " has no SOA")
+	}
+
+	return soas[0].(*dns.SOA), nil
+}
+
+// Load the SOA and all other records of a zone.
+func resolveZone(source db.Backend, zone db.Zone) (soa *dns.SOA, records []dns.RR, err error) {
+	soa, err = resolveZoneSOA(source, zone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = source.IterateZoneRecordSets(zone, "SOA", func(rrSet db.RecordSet) error {
+		rrSetRR, err := resolveRRSet(zone, rrSet)
+		records = append(records, rrSetRR...)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Debug("Records %v", len(records))
+	return soa, records, nil
+}
+
+// Build the IXFR sequence for a list of changes: the current SOA, then for
+// each change the old SOA with the deleted records and the new SOA with the
+// added records, and the current SOA again.
+func ixfrRecords(soa *dns.SOA, entries []journalEntry) []dns.RR {
+	rrs := []dns.RR{soa}
+
+	for _, entry := range entries {
+		rrs = append(rrs, entry.From)
+		rrs = append(rrs, entry.Deleted...)
+		rrs = append(rrs, entry.To)
+		rrs = append(rrs, entry.Added...)
+	}
+
+	return append(rrs, soa)
+}
+
+// Send records to the client over a zone transfer.
+func sendXFR(writer dns.ResponseWriter, request *dns.Msg, records []dns.RR) (err error) {
+	stream := newXFRStream(writer, request)
+
+	for _, rr := range records {
+		if err = stream.Add(rr); err != nil {
+			break
+		}
+	}
+
+	if closeErr := stream.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// An xfrStream sends the records of a zone transfer as they come, packing
+// them into messages that stay below the 64KB limit.
+type xfrStream struct {
+	channel chan *dns.Envelope
+	done    chan error
+	records []dns.RR
+	size    int
+
+	// Set once the transfer has stopped
+	stopped bool
+	err     error
+}
+
+func newXFRStream(writer dns.ResponseWriter, request *dns.Msg) *xfrStream {
+	s := &xfrStream{
+		channel: make(chan *dns.Envelope),
+		done:    make(chan error, 1),
+	}
+
+	transfer := new(dns.Transfer)
+	go func() {
+		s.done <- transfer.Out(writer, request, s.channel)
+	}()
+
+	return s
+}
+
+// Queue a record, sending the queued ones first if it would not fit in the
+// same message.
+func (s *xfrStream) Add(rr dns.RR) error {
+	n := dns.Len(rr)
+
+	if len(s.records) > 0 && s.size+n > xfrMessageSize {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+
+	s.records = append(s.records, rr)
+	s.size += n
+	return nil
+}
+
+// Send the queued records as one message.
+func (s *xfrStream) flush() error {
+	if s.stopped {
+		return s.err
+	}
+
+	select {
+	case s.channel <- &dns.Envelope{RR: s.records}:
+		s.records, s.size = nil, 0
+		return nil
+	case err := <-s.done:
+		// Writing to the client failed
+		s.stopped = true
+		s.err = err
+		if s.err == nil {
+			s.err = errors.New("transfer stopped early")
+		}
+		return s.err
+	}
+}
+
+// Send what is left and end the transfer.
+func (s *xfrStream) Close() error {
+	if len(s.records) > 0 {
+		s.flush()
+	}
+	close(s.channel)
+
+	if s.stopped {
+		return s.err
+	}
+	s.stopped = true
+	return <-s.done
+}
+
+// Answer a zone transfer request with an error.
+func refuseXFR(writer dns.ResponseWriter, request *dns.Msg, rcode int) (err error) {
+	if rcode == dns.RcodeRefused {
+		log.Warn("Refused transfer of %s to %s", request.Question[0].Name, writer.RemoteAddr())
+		stats.AddToMeter("xfr.refused", 1)
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(request, rcode)
+	signResponse(request, m)
+	return writer.WriteMsg(m)
+}
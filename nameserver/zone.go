@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nameserver
+
+import (
+	"database/sql"
+	"strings"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/miekg/dns"
+)
+
+// Find the closest enclosing zone of a name by walking it label by label
+// towards the root, so that a child zone hosted alongside its parent wins.
+// Returns sql.ErrNoRows when we are not authoritative for any part of it.
+func findZone(name string) (zone db.Zone, err error) {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone, err = backend.GetZoneByName(name[off:])
+		if err != sql.ErrNoRows {
+			return zone, err
+		}
+	}
+
+	log.Debug("No zone found for %s", name)
+	return zone, sql.ErrNoRows
+}
+
+// Find the wildcard that may synthesise answers for a name that does not
+// exist, as per RFC 4592. The closest encloser is the longest existing
+// ancestor of the name, and only a wildcard directly below it applies.
+// Returns an empty string if there is no such wildcard.
+func findWildcard(zone db.Zone, name string) (wildcard string, err error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	encloser := zone.Name
+
+	off, end := dns.NextLabel(name, 0)
+	for ; !end && name[off:] != zone.Name; off, end = dns.NextLabel(name, off) {
+		exists, err := backend.NameExists(zone, name[off:])
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			encloser = name[off:]
+			break
+		}
+	}
+
+	wildcard = "*." + encloser
+
+	exists, err := backend.NameExists(zone, wildcard)
+	if err != nil || !exists {
+		return "", err
+	}
+
+	log.Debug("Using wildcard %s for %s", wildcard, name)
+	return wildcard, nil
+}
+
+// Find the delegation, if any, that a query falls under by looking for NS
+// RRSets between the zone apex and the query name. The topmost cut wins, and
+// DS queries at a cut are left to the parent as the DS lives there.
+func findDelegation(zone db.Zone, query dns.Question) (delegation []dns.RR, err error) {
+	name := dns.Fqdn(strings.ToLower(query.Name))
+	if name == zone.Name {
+		return nil, nil
+	}
+
+	// Ancestors of the name below the apex, the closest to the apex last
+	var names []string
+	for off, end := 0, false; !end && name[off:] != zone.Name; off, end = dns.NextLabel(name, off) {
+		names = append(names, name[off:])
+	}
+
+	for i := len(names) - 1; i >= 0; i-- {
+		if i == 0 && query.Qtype == dns.TypeDS {
+			break
+		}
+
+		q := dns.Question{Name: names[i], Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+
+		delegation, err = ResolveRRSetQuery(zone, q)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if len(delegation) > 0 {
+			log.Debug("%s is delegated at %s", name, names[i])
+			return delegation, nil
+		}
+	}
+
+	return nil, nil
+}
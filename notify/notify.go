@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package notify
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/cache"
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/nameserver"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+)
+
+// Sends RFC 1996 NOTIFY messages to the secondaries of zones.
+type Notifier struct {
+	backend  db.Backend
+	targets  []string
+	zones    map[string][]string
+	key      string
+	retries  int
+	timeout  time.Duration
+	interval time.Duration
+
+	lock    sync.Mutex
+	serials map[string]int
+}
+
+var notifier *Notifier
+
+// Set up the notifier and start watching the zones served from backend for
+// serial changes. Zones held in memory are only seen to change once they
+// are reloaded, so secondaries never get notified ahead of the data.
+func Setup(cfg *config.Configuration, backend db.Backend) {
+	notifier = NewNotifier(cfg, backend)
+
+	// Pass NOTIFY from upstream on to the secondaries
+	nameserver.OnNotify(func(name string) {
+		zone, err := notifier.backend.GetZoneByName(name)
+		if err == sql.ErrNoRows {
+			// A secondary zone not transferred yet, its secondaries hear
+			// of it once it is
+			return
+		} else if err != nil {
+			log.Error("Error getting zone %s to pass NOTIFY on: %s", name, err)
+			return
+		}
+		notifier.Notify(zone)
+	})
+
+	if notifier.interval > 0 {
+		go notifier.Watch()
+	}
+}
+
+func NewNotifier(cfg *config.Configuration, backend db.Backend) *Notifier {
+	n := &Notifier{
+		backend:  backend,
+		targets:  nameserver.WithPorts(cfg.NotifyTargets),
+		zones:    make(map[string][]string),
+		key:      cfg.NotifyKey,
+		retries:  cfg.NotifyRetries,
+		timeout:  time.Duration(cfg.NotifyTimeout) * time.Second,
+		interval: time.Duration(cfg.NotifyInterval) * time.Second,
+		serials:  make(map[string]int),
+	}
+
+	if n.timeout <= 0 {
+		n.timeout = 2 * time.Second
+	}
+
+	for _, zone := range cfg.NotifyZones {
+		n.zones[dns.Fqdn(strings.ToLower(zone.Name))] = nameserver.WithPorts(zone.Targets)
+	}
+
+	return n
+}
+
+// Notify the secondaries of a zone in the background, returning the targets.
+func NotifyZone(zone db.Zone) []string {
+	if notifier == nil {
+		return nil
+	}
+	return notifier.Notify(zone)
+}
+
+// Get the targets to notify for a zone.
+func (n *Notifier) Targets(zone db.Zone) []string {
+	if targets, ok := n.zones[zone.Name]; ok {
+		return targets
+	}
+	return n.targets
+}
+
+// Notify the secondaries of a zone in the background, returning the targets.
+func (n *Notifier) Notify(zone db.Zone) []string {
+	targets := n.Targets(zone)
+
+	for _, target := range targets {
+		go n.send(zone, target)
+	}
+	return targets
+}
+
+// Poll the zones for serial changes, notifying the secondaries of those that
+// changed and snapshotting the ones journaled for IXFR. The first poll only
+// records the serials.
+func (n *Notifier) Watch() {
+	log.Info("Watching zones for serial changes every %s", n.interval)
+
+	first := true
+	for {
+		zones, err := n.backend.GetZones()
+		if err != nil {
+			log.Error("Error polling zone serials: %s", err)
+		}
+
+		for _, zone := range zones {
+			n.lock.Lock()
+			serial, seen := n.serials[zone.Id]
+			n.serials[zone.Id] = zone.Serial
+			n.lock.Unlock()
+
+			if !seen || serial != zone.Serial {
+				nameserver.Snapshot(n.backend, zone)
+			}
+
+			if !first && (!seen || serial != zone.Serial) {
+				log.Info("Serial of %s changed to %d", zone.Name, zone.Serial)
+				cache.PurgeZone(zone.Name)
+				n.Notify(zone)
+			}
+		}
+
+		if err == nil {
+			first = false
+		}
+		time.Sleep(n.interval)
+	}
+}
+
+// Send a NOTIFY for a zone to a target, retrying with exponential backoff
+// until it is acknowledged or the retries run out.
+func (n *Notifier) send(zone db.Zone, target string) (err error) {
+	m := new(dns.Msg)
+	m.SetNotify(zone.Name)
+
+	c, err := n.newClient(m)
+	if err != nil {
+		log.Error("Error setting up NOTIFY for %s: %s", zone.Name, err)
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 0; attempt <= n.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var r *dns.Msg
+
+		r, _, err = c.Exchange(m, target)
+		if err == nil && r.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("%s answered %s", target, dns.RcodeToString[r.Rcode])
+		}
+		if err == nil {
+			log.Debug("NOTIFY for %s acknowledged by %s", zone.Name, target)
+			stats.AddToMeter("notify.sent", 1)
+			return nil
+		}
+
+		log.Warn("NOTIFY for %s to %s failed (attempt %d): %s", zone.Name, target, attempt+1, err)
+	}
+
+	stats.AddToMeter("notify.failed", 1)
+	return err
+}
+
+// Create a client for talking to the secondaries, signing m with our key if
+// we have one.
+func (n *Notifier) newClient(m *dns.Msg) (c *dns.Client, err error) {
+	c = new(dns.Client)
+	c.ReadTimeout = n.timeout
+
+	if c.TsigSecret, err = nameserver.SignMsg(m, n.key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package notify
+
+import (
+	"sync"
+
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/nameserver"
+)
+
+// The serial a secondary has for a zone.
+type TargetStatus struct {
+	Target string
+	Serial uint32
+	InSync bool
+	Error  string
+}
+
+// How far a zone has propagated to its secondaries.
+type ZoneStatus struct {
+	Zone    string
+	Serial  int
+	InSync  bool
+	Targets []TargetStatus
+}
+
+// Query the secondaries of a zone for their serial.
+func GetZoneStatus(zone db.Zone) ZoneStatus {
+	if notifier == nil {
+		return ZoneStatus{Zone: zone.Name, Serial: zone.Serial}
+	}
+	return notifier.Status(zone)
+}
+
+// Query the secondaries of a zone for its SOA in parallel, comparing their
+// serial with the one in the database. A zone is in sync when every
+// secondary has at least our serial.
+func (n *Notifier) Status(zone db.Zone) ZoneStatus {
+	targets := n.Targets(zone)
+
+	status := ZoneStatus{
+		Zone:    zone.Name,
+		Serial:  zone.Serial,
+		InSync:  true,
+		Targets: make([]TargetStatus, len(targets)),
+	}
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+
+			ts := TargetStatus{Target: target}
+
+			serial, err := nameserver.QuerySerial(zone.Name, target, n.key, n.timeout)
+			if err != nil {
+				ts.Error = err.Error()
+			} else {
+				ts.Serial = serial
+				ts.InSync = !nameserver.SerialGreater(uint32(zone.Serial), serial)
+			}
+
+			status.Targets[i] = ts
+		}(i, target)
+	}
+	wg.Wait()
+
+	for _, ts := range status.Targets {
+		status.InSync = status.InSync && ts.InSync
+	}
+	return status
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package secondary
+
+import (
+	"strings"
+
+	"github.com/ekarlso/gomdns/db"
+)
+
+// A Backend serves the secondary zones from memory in front of another
+// backend holding the rest.
+type Backend struct {
+	next db.Backend
+}
+
+// Serve the secondary zones in front of next.
+func Wrap(next db.Backend) *Backend {
+	return &Backend{next: next}
+}
+
+func (b *Backend) GetZoneByName(zoneName string) (db.Zone, error) {
+	if zone, err := store.GetZoneByName(zoneName); err == nil {
+		return zone, nil
+	}
+	return b.next.GetZoneByName(zoneName)
+}
+
+func (b *Backend) GetZones() (zones []db.Zone, err error) {
+	zones, err = b.next.GetZones()
+	if err != nil {
+		return zones, err
+	}
+
+	secondaries, _ := store.GetZones()
+	return append(zones, secondaries...), nil
+}
+
+func (b *Backend) GetRecordSet(zone db.Zone, rrName string, rrType string) (db.RecordSet, error) {
+	if isSecondary(zone) {
+		return store.GetRecordSet(zone, rrName, rrType)
+	}
+	return b.next.GetRecordSet(zone, rrName, rrType)
+}
+
+func (b *Backend) NameExists(zone db.Zone, rrName string) (bool, error) {
+	if isSecondary(zone) {
+		return store.NameExists(zone, rrName)
+	}
+	return b.next.NameExists(zone, rrName)
+}
+
+func (b *Backend) IterateZoneRecordSets(zone db.Zone, notType string, fn func(db.RecordSet) error) error {
+	if isSecondary(zone) {
+		return store.IterateZoneRecordSets(zone, notType, fn)
+	}
+	return b.next.IterateZoneRecordSets(zone, notType, fn)
+}
+
+// Whether a zone is one of ours, which carry the id prefix.
+func isSecondary(zone db.Zone) bool {
+	return strings.HasPrefix(zone.Id, idPrefix)
+}
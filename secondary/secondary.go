@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package secondary
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/memory"
+	"github.com/ekarlso/gomdns/nameserver"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+)
+
+// Prefix of the ids of secondary zones, setting them apart from those of
+// other backends.
+const idPrefix = "secondary:"
+
+// How long to wait before trying again to load a zone we have never
+// managed to transfer, which has no SOA retry timer to go by.
+const initialRetry = 60 * time.Second
+
+// Shortest refresh or retry interval we go by, so a zone with a SOA asking
+// for 0 does not have us hammering its primaries.
+const minInterval = 60 * time.Second
+
+// A zone pulled from its primaries, along with the state of its SOA
+// refresh, retry and expire timers.
+type Zone struct {
+	name      string
+	primaries []string
+	key       string
+
+	soa     *dns.SOA
+	records map[string]dns.RR
+	loaded  time.Time
+	notify  chan bool
+}
+
+// The secondary zones served, once transferred.
+var (
+	store = memory.NewStore(nil)
+	zones = make(map[string]*Zone)
+)
+
+// Start keeping the configured secondary zones in sync with their
+// primaries, refreshing them early on a NOTIFY.
+func Setup(cfg *config.Configuration) {
+	store.OnLoad(func(zone db.Zone) { nameserver.Snapshot(store, zone) })
+
+	for _, zc := range cfg.SecondaryZones {
+		zone := NewZone(zc.Name, zc.Primaries, zc.Key)
+		zones[zone.name] = zone
+
+		// NOTIFY triggers the first transfer as well
+		nameserver.AcceptNotify(zone.name)
+
+		log.Info("Serving %s as a secondary of %s", zone.name, strings.Join(zone.primaries, ", "))
+		go zone.Run()
+	}
+
+	if len(zones) > 0 {
+		nameserver.OnNotify(func(name string) { Refresh(name) })
+	}
+}
+
+func NewZone(name string, primaries []string, key string) *Zone {
+	return &Zone{
+		name:      dns.Fqdn(strings.ToLower(name)),
+		primaries: nameserver.WithPorts(primaries),
+		key:       key,
+		records:   make(map[string]dns.RR),
+		notify:    make(chan bool, 1),
+	}
+}
+
+// Check a secondary zone for changes now.
+func Refresh(zoneName string) {
+	zone, ok := zones[dns.Fqdn(strings.ToLower(zoneName))]
+	if !ok {
+		return
+	}
+
+	select {
+	case zone.notify <- true:
+	default:
+	}
+}
+
+// Keep the zone in sync, checking its primaries every SOA refresh interval,
+// every retry interval after a failure and dropping it once it is expired.
+func (z *Zone) Run() {
+	for {
+		wait := z.check()
+
+		select {
+		case <-time.After(wait):
+		case <-z.notify:
+			log.Debug("Refreshing %s on NOTIFY", z.name)
+		}
+	}
+}
+
+// Check the primaries for changes, returning how long to wait until the
+// next check.
+func (z *Zone) check() time.Duration {
+	err := z.update()
+	if err == nil {
+		z.loaded = time.Now()
+		return interval(z.soa.Refresh)
+	}
+
+	log.Warn("Error refreshing %s: %s", z.name, err)
+
+	if z.soa == nil {
+		return initialRetry
+	}
+
+	if time.Since(z.loaded) > time.Duration(z.soa.Expire)*time.Second {
+		log.Error("Zone %s expired, no longer serving it", z.name)
+		stats.AddToMeter("secondary.expired", 1)
+
+		store.Remove(z.name)
+		z.soa = nil
+		z.records = make(map[string]dns.RR)
+		return initialRetry
+	}
+
+	return interval(z.soa.Retry)
+}
+
+// Turn a SOA timer into a wait of at least minInterval.
+func interval(seconds uint32) time.Duration {
+	wait := time.Duration(seconds) * time.Second
+	if wait < minInterval {
+		return minInterval
+	}
+	return wait
+}
+
+// Transfer the zone from the first primary that answers, when its serial
+// is newer than ours.
+func (z *Zone) update() (err error) {
+	err = errors.New("no primaries")
+
+	for _, primary := range z.primaries {
+		var serial uint32
+
+		serial, err = nameserver.QuerySerial(z.name, primary, z.key, 0)
+		if err != nil {
+			log.Debug("Error getting the serial of %s from %s: %s", z.name, primary, err)
+			continue
+		}
+
+		if z.soa != nil && !nameserver.SerialGreater(serial, z.soa.Serial) {
+			return nil
+		}
+
+		if err = z.transfer(primary); err == nil {
+			return nil
+		}
+		log.Debug("Error transferring %s from %s: %s", z.name, primary, err)
+	}
+
+	return err
+}
+
+// Transfer the zone from a primary, incrementally when we have a copy of
+// it already, and start serving the result.
+func (z *Zone) transfer(primary string) (err error) {
+	m := new(dns.Msg)
+	if z.soa != nil {
+		m.SetIxfr(z.name, z.soa.Serial, z.soa.Ns, z.soa.Mbox)
+	} else {
+		m.SetAxfr(z.name)
+	}
+
+	t := new(dns.Transfer)
+	if t.TsigSecret, err = nameserver.SignMsg(m, z.key); err != nil {
+		return err
+	}
+
+	envelopes, err := t.In(m, primary)
+	if err != nil {
+		stats.AddToMeter("secondary.transfer.failed", 1)
+		return err
+	}
+
+	var rrs []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			stats.AddToMeter("secondary.transfer.failed", 1)
+			return e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+
+	if err = z.apply(rrs); err != nil {
+		stats.AddToMeter("secondary.transfer.failed", 1)
+		return err
+	}
+
+	zone := memory.NewZone(idPrefix+z.name, z.soa)
+
+	records := []dns.RR{z.soa}
+	for _, rr := range z.records {
+		records = append(records, rr)
+	}
+	store.Put(zone, memory.RecordSets(zone, records))
+
+	log.Info("Transferred %s with serial %d from %s", z.name, z.soa.Serial, primary)
+	stats.AddToMeter("secondary.transfer", 1)
+	return nil
+}
+
+// Apply the answer to an AXFR or IXFR to our copy of the zone. As per
+// RFC 1995 an IXFR may be answered with the whole zone, the changes as
+// pairs of deletions and additions, or only the SOA when we are up to date.
+func (z *Zone) apply(rrs []dns.RR) (err error) {
+	if len(rrs) == 0 {
+		return errors.New("empty transfer")
+	}
+
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return errors.New("transfer does not start with a SOA")
+	}
+
+	if len(rrs) == 1 {
+		if z.soa == nil {
+			return errors.New("transfer holds only a SOA")
+		}
+		return nil
+	}
+
+	last, ok := rrs[len(rrs)-1].(*dns.SOA)
+	if !ok || last.Serial != soa.Serial {
+		return errors.New("transfer does not end with the SOA")
+	}
+
+	body := rrs[1 : len(rrs)-1]
+
+	incremental := false
+	if len(body) > 0 && z.soa != nil {
+		_, incremental = body[0].(*dns.SOA)
+	}
+
+	if !incremental {
+		records := make(map[string]dns.RR, len(body))
+		for _, rr := range body {
+			if _, ok := rr.(*dns.SOA); !ok {
+				records[rr.String()] = rr
+			}
+		}
+
+		z.soa, z.records = soa, records
+		return nil
+	}
+
+	// Each change starts with the old SOA followed by the deleted records
+	// and the new SOA followed by the added ones
+	records := make(map[string]dns.RR, len(z.records))
+	for key, rr := range z.records {
+		records[key] = rr
+	}
+
+	deleting := false
+	for _, rr := range body {
+		if _, ok := rr.(*dns.SOA); ok {
+			deleting = !deleting
+			continue
+		}
+
+		if deleting {
+			delete(records, rr.String())
+		} else {
+			records[rr.String()] = rr
+		}
+	}
+
+	z.soa, z.records = soa, records
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package secondary
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func parseRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func soaRR(t *testing.T, serial uint32) dns.RR {
+	return parseRR(t, fmt.Sprintf("example.org. 3600 IN SOA ns1.example.org. admin.example.org. %d 3600 600 86400 300", serial))
+}
+
+func aRR(t *testing.T, name string) dns.RR {
+	return parseRR(t, name+".example.org. 3600 IN A 192.0.2.1")
+}
+
+// Check that a zone is at serial and holds the A records of names.
+func checkZone(t *testing.T, z *Zone, serial uint32, names ...string) {
+	if z.soa == nil || z.soa.Serial != serial {
+		t.Errorf("expected serial %d, got %v", serial, z.soa)
+	}
+	if len(z.records) != len(names) {
+		t.Errorf("expected %v, got %v", names, z.records)
+		return
+	}
+	for _, name := range names {
+		if _, ok := z.records[aRR(t, name).String()]; !ok {
+			t.Errorf("expected %v, got %v", names, z.records)
+			return
+		}
+	}
+}
+
+// A zone transferred at serial 1 holding a and b.
+func loadedZone(t *testing.T) *Zone {
+	z := NewZone("example.org.", nil, "")
+	if err := z.apply([]dns.RR{soaRR(t, 1), aRR(t, "a"), aRR(t, "b"), soaRR(t, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestApplyAXFR(t *testing.T) {
+	checkZone(t, loadedZone(t), 1, "a", "b")
+}
+
+func TestApplyIXFR(t *testing.T) {
+	z := loadedZone(t)
+
+	// 1 to 2 deletes a and adds c, 2 to 3 deletes b and adds d
+	err := z.apply([]dns.RR{
+		soaRR(t, 3),
+		soaRR(t, 1), aRR(t, "a"), soaRR(t, 2), aRR(t, "c"),
+		soaRR(t, 2), aRR(t, "b"), soaRR(t, 3), aRR(t, "d"),
+		soaRR(t, 3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkZone(t, z, 3, "c", "d")
+}
+
+func TestApplyIXFRAsAXFR(t *testing.T) {
+	z := loadedZone(t)
+
+	if err := z.apply([]dns.RR{soaRR(t, 2), aRR(t, "x"), aRR(t, "y"), soaRR(t, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	checkZone(t, z, 2, "x", "y")
+}
+
+func TestApplyIXFRSerialWrap(t *testing.T) {
+	z := NewZone("example.org.", nil, "")
+	if err := z.apply([]dns.RR{soaRR(t, 4294967295), aRR(t, "a"), soaRR(t, 4294967295)}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := z.apply([]dns.RR{
+		soaRR(t, 0),
+		soaRR(t, 4294967295), aRR(t, "a"), soaRR(t, 0), aRR(t, "b"),
+		soaRR(t, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkZone(t, z, 0, "b")
+}
+
+func TestApplySOAOnly(t *testing.T) {
+	z := loadedZone(t)
+
+	if err := z.apply([]dns.RR{soaRR(t, 1)}); err != nil {
+		t.Errorf("expected an up to date answer to be accepted, got %s", err)
+	}
+	checkZone(t, z, 1, "a", "b")
+
+	z = NewZone("example.org.", nil, "")
+	if err := z.apply([]dns.RR{soaRR(t, 1)}); err == nil {
+		t.Errorf("expected an error for a lone SOA without a copy of the zone")
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	tests := map[string][]dns.RR{
+		"empty":            nil,
+		"no leading SOA":   {aRR(t, "a"), soaRR(t, 1)},
+		"no trailing SOA":  {soaRR(t, 2), aRR(t, "a")},
+		"mismatching SOAs": {soaRR(t, 2), aRR(t, "a"), soaRR(t, 3)},
+	}
+
+	for what, rrs := range tests {
+		z := loadedZone(t)
+		if err := z.apply(rrs); err == nil {
+			t.Errorf("%s: expected an error", what)
+		}
+		checkZone(t, z, 1, "a", "b")
+	}
+}
+
+func TestInterval(t *testing.T) {
+	if wait := interval(0); wait != minInterval {
+		t.Errorf("expected a 0 timer to wait %s, got %s", minInterval, wait)
+	}
+	if wait := interval(3600); wait.Seconds() != 3600 {
+		t.Errorf("expected to wait an hour, got %s", wait)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	log "code.google.com/p/log4go"
 	"github.com/ekarlso/gomdns/api"
 	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
 	"github.com/ekarlso/gomdns/nameserver"
 )
 
@@ -33,8 +34,8 @@ type Server struct {
 	stopped    bool
 }
 
-func NewServer(cfg *config.Configuration) (*Server, error) {
-	apiServer := api.NewServer(cfg)
+func NewServer(cfg *config.Configuration, backend db.Backend) (*Server, error) {
+	apiServer := api.NewServer(cfg, backend)
 	nameServer := nameserver.NewServer(cfg)
 
 	return &Server{
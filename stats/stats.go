@@ -52,6 +52,11 @@ func AddToMeter(key string, value int64) {
 	c.Mark(value)
 }
 
+func SetGauge(key string, value int64) {
+	g := metrics.GetOrRegisterGauge(strings.ToLower(key), NameServerStats)
+	g.Update(value)
+}
+
 func MeterQuery(qType string, value int64) {
 	AddToMeter(QueryKey+"."+qType, value)
 }
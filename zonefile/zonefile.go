@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2014 Hewlett-Packard Development Company, L.P.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package zonefile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/ekarlso/gomdns/config"
+	"github.com/ekarlso/gomdns/db"
+	"github.com/ekarlso/gomdns/memory"
+	"github.com/ekarlso/gomdns/nameserver"
+	"github.com/ekarlso/gomdns/stats"
+	"github.com/miekg/dns"
+)
+
+// A file of the directory as last seen, and the zone it holds.
+type fileState struct {
+	modTime time.Time
+	size    int64
+	zone    string
+}
+
+// A Backend serves the zones of a directory of RFC 1035 master files from
+// memory, picking up files as they are added, changed or removed.
+type Backend struct {
+	store *memory.Store
+	dir   string
+	files map[string]fileState
+}
+
+// Load the zone files of the directory the DSN points at, and keep
+// watching it for changes.
+func Setup(cfg *config.Configuration) (b *Backend, err error) {
+	_, dir := cfg.StorageDriverDSN()
+
+	b = NewBackend(dir)
+	if err = b.Scan(); err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(cfg.NameServerReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+	go b.Watch(interval)
+
+	return b, nil
+}
+
+func NewBackend(dir string) *Backend {
+	b := &Backend{
+		store: memory.NewStore(nil),
+		dir:   dir,
+		files: make(map[string]fileState),
+	}
+	b.store.OnLoad(func(zone db.Zone) { nameserver.Snapshot(b.store, zone) })
+
+	return b
+}
+
+func (b *Backend) GetZoneByName(zoneName string) (db.Zone, error) {
+	return b.store.GetZoneByName(zoneName)
+}
+
+func (b *Backend) GetZones() ([]db.Zone, error) {
+	return b.store.GetZones()
+}
+
+func (b *Backend) GetRecordSet(zone db.Zone, rrName string, rrType string) (db.RecordSet, error) {
+	return b.store.GetRecordSet(zone, rrName, rrType)
+}
+
+func (b *Backend) NameExists(zone db.Zone, rrName string) (bool, error) {
+	return b.store.NameExists(zone, rrName)
+}
+
+func (b *Backend) IterateZoneRecordSets(zone db.Zone, notType string, fn func(db.RecordSet) error) error {
+	return b.store.IterateZoneRecordSets(zone, notType, fn)
+}
+
+// Load the files that are new or changed since the last scan and drop the
+// zones of those that are gone. Files that fail to parse leave the zone
+// they held as it was.
+func (b *Backend) Scan() (err error) {
+	infos, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(infos))
+
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(b.dir, info.Name())
+		seen[path] = true
+
+		state, ok := b.files[path]
+		if ok && state.modTime.Equal(info.ModTime()) && state.size == info.Size() {
+			continue
+		}
+		state.modTime = info.ModTime()
+		state.size = info.Size()
+
+		zone, rrSets, err := parseFile(path, originOf(info.Name()))
+		if err != nil {
+			log.Error("Error loading zone file %s: %s", path, err)
+			b.files[path] = state
+			continue
+		}
+
+		if state.zone != "" && state.zone != zone.Name {
+			b.store.Remove(state.zone)
+		}
+		state.zone = zone.Name
+		b.files[path] = state
+
+		b.store.Put(zone, rrSets)
+
+		log.Info("Loaded zone %s with serial %d from %s", zone.Name, zone.Serial, path)
+		stats.AddToMeter("zonefile.loaded", 1)
+	}
+
+	for path, state := range b.files {
+		if seen[path] {
+			continue
+		}
+
+		if state.zone != "" {
+			log.Info("Dropping zone %s as %s is gone", state.zone, path)
+			b.store.Remove(state.zone)
+		}
+		delete(b.files, path)
+	}
+
+	return nil
+}
+
+// Scan the directory every interval.
+func (b *Backend) Watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := b.Scan(); err != nil {
+			log.Warn("Error scanning zone files in %s: %s", b.dir, err)
+		}
+	}
+}
+
+// The origin of a zone file without $ORIGIN, its name less any .zone
+// suffix.
+func originOf(fileName string) string {
+	return dns.Fqdn(strings.TrimSuffix(fileName, ".zone"))
+}
+
+// Parse a zone file into a zone and its RRSets. The zone is named after its
+// SOA, which must come first.
+func parseFile(path string, origin string) (zone db.Zone, rrSets []db.RecordSet, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return zone, nil, err
+	}
+	defer f.Close()
+
+	var (
+		soa *dns.SOA
+		rrs []dns.RR
+	)
+
+	zp := dns.NewZoneParser(f, origin, path)
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa == nil {
+			if soa, ok = rr.(*dns.SOA); !ok {
+				return zone, nil, errors.New("zone does not start with a SOA")
+			}
+			zone = memory.NewZone(strings.ToLower(soa.Hdr.Name), soa)
+		}
+
+		if !dns.IsSubDomain(zone.Name, strings.ToLower(rr.Header().Name)) {
+			log.Warn("Ignoring %s in %s, it is outside of %s", rr.Header().Name, path, zone.Name)
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+
+	if err = zp.Err(); err != nil {
+		return zone, nil, err
+	}
+	if soa == nil {
+		return zone, nil, errors.New("zone has no SOA")
+	}
+
+	return zone, memory.RecordSets(zone, rrs), nil
+}